@@ -1,16 +1,27 @@
 package ztnet
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"slices"
 	"strings"
 
+	"github.com/coredns/coredns/plugin/metadata"
 	"github.com/miekg/dns"
 )
 
-// AllowedNets stores source CIDRs allowed to query the plugin zone.
+// ACL modes selecting how the allowlist is built on refresh.
+const (
+	ACLModeNetworks = "networks"
+	ACLModeMembers  = "members"
+)
+
+// AllowedNets stores source CIDRs and individual IPs allowed to query the plugin zone.
 type AllowedNets struct {
 	nets []*net.IPNet
+	ips  map[string]struct{}
 }
 
 // NewAllowedNets parses CIDRs and always includes loopback CIDRs.
@@ -30,6 +41,19 @@ func NewAllowedNets(cidrs []string) (*AllowedNets, error) {
 	return out, nil
 }
 
+// NewMemberAllowedNets builds an allowlist of explicit CIDRs plus individual member IPs.
+func NewMemberAllowedNets(cidrs []string, ips []net.IP) (*AllowedNets, error) {
+	out, err := NewAllowedNets(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	out.ips = make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		out.ips[memberIPKey(ip)] = struct{}{}
+	}
+	return out, nil
+}
+
 // Contains reports whether ip is present in any allowed CIDR.
 func (a *AllowedNets) Contains(ip net.IP) bool {
 	if a == nil || ip == nil {
@@ -38,6 +62,9 @@ func (a *AllowedNets) Contains(ip net.IP) bool {
 	if v4 := ip.To4(); v4 != nil {
 		ip = v4
 	}
+	if _, ok := a.ips[ip.String()]; ok {
+		return true
+	}
 	for _, n := range a.nets {
 		if n.Contains(ip) {
 			return true
@@ -46,6 +73,171 @@ func (a *AllowedNets) Contains(ip net.IP) bool {
 	return false
 }
 
+// ContainsNet reports whether every address of n is inside one allowed CIDR.
+// Individual member IPs never match a prefix.
+func (a *AllowedNets) ContainsNet(n *net.IPNet) bool {
+	if a == nil || n == nil {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	for _, allowed := range a.nets {
+		if allowedOnes, _ := allowed.Mask.Size(); allowedOnes <= ones && allowed.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDRs lists the allowlist networks and individual member IPs in a stable order.
+func (a *AllowedNets) CIDRs() []string {
+	if a == nil {
+		return nil
+	}
+	out := make([]string, 0, len(a.nets)+len(a.ips))
+	for _, n := range a.nets {
+		out = append(out, n.String())
+	}
+	ips := make([]string, 0, len(a.ips))
+	for ip := range a.ips {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	return append(out, ips...)
+}
+
+// parseCIDRs parses a CIDR list without adding implicit entries.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("parse CIDR %q: %w", cidr, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type httpRequester interface {
+	Request() *http.Request
+}
+
+// clientSourceIP returns the querier address, honouring a client address propagated by the
+// transport (CoreDNS metadata label or DoH X-Forwarded-For) only when the peer is a trusted proxy.
+func clientSourceIP(ctx context.Context, w dns.ResponseWriter, trusted []*net.IPNet, metadataLabel string) net.IP {
+	src := extractSourceIP(w)
+	if len(trusted) == 0 || !containsIP(trusted, src) {
+		return src
+	}
+	if metadataLabel != "" {
+		if f := metadata.ValueFunc(ctx, metadataLabel); f != nil {
+			if ip := net.ParseIP(strings.TrimSpace(f())); ip != nil {
+				return ip
+			}
+		}
+	}
+	if hr, ok := w.(httpRequester); ok && hr.Request() != nil {
+		if ip := forwardedFor(hr.Request().Header, trusted); ip != nil {
+			return ip
+		}
+	}
+	return src
+}
+
+// forwardedFor walks X-Forwarded-For right to left and returns the first hop that is not a trusted proxy.
+func forwardedFor(h http.Header, trusted []*net.IPNet) net.IP {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var last net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return last
+		}
+		last = ip
+		if !containsIP(trusted, ip) {
+			return ip
+		}
+	}
+	return last
+}
+
+// clientSubnet returns the EDNS Client Subnet option carried by r when the direct
+// peer src is a trusted forwarder, and nil otherwise.
+func clientSubnet(src net.IP, r *dns.Msg, trusted []*net.IPNet) *dns.EDNS0_SUBNET {
+	if len(trusted) == 0 || !containsIP(trusted, src) {
+		return nil
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.Address != nil {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// ecsNet returns the client prefix of ecs, or nil when it is empty (/0) or malformed.
+func ecsNet(ecs *dns.EDNS0_SUBNET) *net.IPNet {
+	if ecs == nil || ecs.SourceNetmask == 0 {
+		return nil
+	}
+	bits := 32
+	ip := ecs.Address.To4()
+	if ecs.Family == 2 {
+		bits, ip = 128, ecs.Address.To16()
+	}
+	if ip == nil || int(ecs.SourceNetmask) > bits {
+		return nil
+	}
+	mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// ecsWriter echoes the client's EDNS Client Subnet option in every response with
+// SCOPE PREFIX-LENGTH set to the source prefix (RFC 7871), so caches keep answers per client prefix.
+type ecsWriter struct {
+	dns.ResponseWriter
+	ecs *dns.EDNS0_SUBNET
+	req *dns.OPT
+}
+
+func (e *ecsWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(e.req.UDPSize(), e.req.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        e.ecs.Family,
+		SourceNetmask: e.ecs.SourceNetmask,
+		SourceScope:   e.ecs.SourceNetmask,
+		Address:       e.ecs.Address,
+	})
+	return e.ResponseWriter.WriteMsg(m)
+}
+
 func extractSourceIP(w dns.ResponseWriter) net.IP {
 	if w == nil || w.RemoteAddr() == nil {
 		return nil
@@ -0,0 +1,120 @@
+package ztnet
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminConfig defines the optional loopback-only admin HTTP endpoint.
+type AdminConfig struct {
+	Addr      string
+	TokenFile string
+}
+
+// validateLoopbackAddr requires a host:port listen address bound to loopback.
+func validateLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("address %s is not loopback", addr)
+	}
+	return nil
+}
+
+type adminRecord struct {
+	A    []string `json:"a,omitempty"`
+	AAAA []string `json:"aaaa,omitempty"`
+}
+
+type adminSnapshot struct {
+	Zone        string                 `json:"zone"`
+	Serial      uint32                 `json:"serial"`
+	LastRefresh *time.Time             `json:"last_refresh,omitempty"`
+	LastError   string                 `json:"last_error,omitempty"`
+	Ready       bool                   `json:"ready"`
+	Degraded    bool                   `json:"degraded"`
+	Allowed     []string               `json:"allowed"`
+	Records     map[string]adminRecord `json:"records"`
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+func (p *ZtnetPlugin) adminSnapshot() adminSnapshot {
+	s := p.cache.load()
+	out := adminSnapshot{Zone: p.zone, Serial: s.serial, Allowed: s.allowed.CIDRs(), Records: make(map[string]adminRecord, len(s.a))}
+	for name, ips := range s.a {
+		rec := out.Records[name]
+		rec.A = ipStrings(ips)
+		out.Records[name] = rec
+	}
+	for name, ips := range s.aaaa {
+		rec := out.Records[name]
+		rec.AAAA = ipStrings(ips)
+		out.Records[name] = rec
+	}
+	st := p.poller().status.get()
+	if !st.lastOK.IsZero() {
+		out.LastRefresh = &st.lastOK
+	}
+	out.LastError = st.lastErr
+	out.Ready = p.Ready()
+	out.Degraded = p.Degraded()
+	return out
+}
+
+// adminHandler serves GET /snapshot and POST /refresh behind a bearer token read from TokenFile.
+func (p *ZtnetPlugin) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.adminSnapshot())
+	})
+	mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := p.poller().refresh(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]uint32{"serial": p.cache.Serial()})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := readSecretFile(p.cfg.Admin.TokenFile)
+		if err != nil {
+			http.Error(w, "admin token unavailable", http.StatusInternalServerError)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -9,10 +9,12 @@ import (
 	"math/rand/v2"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
-var ErrUnauthorized = errors.New("unauthorized")
+// ErrNotModified reports a 304 answer to a conditional request: the resource is unchanged.
+var ErrNotModified = errors.New("not modified")
 
 const (
 	baseRetryDelay = 100 * time.Millisecond
@@ -25,6 +27,7 @@ type Member struct {
 	Name          string   `json:"name"`
 	Authorized    bool     `json:"authorized"`
 	IPAssignments []string `json:"ipAssignments"`
+	Tags          []string `json:"tags"`
 }
 
 func parseJSONFlexibleString(raw json.RawMessage) (string, error) {
@@ -45,13 +48,14 @@ func parseJSONFlexibleString(raw json.RawMessage) (string, error) {
 // UnmarshalJSON accepts multiple ZTNET member payload variants.
 func (m *Member) UnmarshalJSON(data []byte) error {
 	var aux struct {
-		NodeIDCamel   json.RawMessage `json:"nodeId"`
-		NodeIDLower   json.RawMessage `json:"nodeid"`
-		ID            json.RawMessage `json:"id"`
-		Address       json.RawMessage `json:"address"`
-		Name          string          `json:"name"`
-		Authorized    bool            `json:"authorized"`
-		IPAssignments []string        `json:"ipAssignments"`
+		NodeIDCamel   json.RawMessage   `json:"nodeId"`
+		NodeIDLower   json.RawMessage   `json:"nodeid"`
+		ID            json.RawMessage   `json:"id"`
+		Address       json.RawMessage   `json:"address"`
+		Name          string            `json:"name"`
+		Authorized    bool              `json:"authorized"`
+		IPAssignments []string          `json:"ipAssignments"`
+		Tags          []json.RawMessage `json:"tags"`
 	}
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
@@ -60,6 +64,17 @@ func (m *Member) UnmarshalJSON(data []byte) error {
 	m.Name = aux.Name
 	m.Authorized = aux.Authorized
 	m.IPAssignments = aux.IPAssignments
+	m.Tags = nil
+	for _, raw := range aux.Tags {
+		// ZeroTier numeric [id, value] tag pairs are ignored; only string tags are usable in views.
+		var tag string
+		if err := json.Unmarshal(raw, &tag); err != nil {
+			continue
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
 
 	candidates := []json.RawMessage{aux.NodeIDCamel, aux.NodeIDLower, aux.ID, aux.Address}
 	for _, raw := range candidates {
@@ -97,6 +112,50 @@ type APIClient struct {
 	HTTPClient *http.Client
 	MaxRetries int
 	Jitter     func(max time.Duration) time.Duration
+	// Breaker, when set, short-circuits calls while the API is unavailable.
+	Breaker *circuitBreaker
+	// FallbackURLs are tried in order when BaseURL fails; Zone labels per-endpoint metrics.
+	FallbackURLs []string
+	Zone         string
+	// MaxResponseBytes limits response bodies; 0 uses a 10 MiB default.
+	MaxResponseBytes int64
+
+	endpointsMu sync.Mutex
+	active      int
+
+	validatorsMu sync.Mutex
+	validators   map[string]cacheValidator
+}
+
+// cacheValidator holds the ETag/Last-Modified of the last decoded response for a path.
+type cacheValidator struct {
+	etag         string
+	lastModified string
+}
+
+func (c *APIClient) validator(path string) cacheValidator {
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	return c.validators[path]
+}
+
+// storeValidator remembers the validators of a response decoded into out, or forgets
+// them when out is a validatedResult that may not be revalidated.
+func (c *APIClient) storeValidator(path string, resp *http.Response, out any) {
+	v := cacheValidator{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	if vr, ok := out.(validatedResult); ok && !vr.cacheable() {
+		v = cacheValidator{}
+	}
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	if v == (cacheValidator{}) {
+		delete(c.validators, path)
+		return
+	}
+	if c.validators == nil {
+		c.validators = make(map[string]cacheValidator)
+	}
+	c.validators[path] = v
 }
 
 func (c *APIClient) retryDelay(attempt int) time.Duration {
@@ -106,16 +165,19 @@ func (c *APIClient) retryDelay(attempt int) time.Duration {
 	}
 	jitter := c.Jitter
 	if jitter == nil {
-		jitter = func(max time.Duration) time.Duration {
-			if max <= 0 {
-				return 0
-			}
-			return time.Duration(rand.Int64N(max.Nanoseconds() + 1))
-		}
+		jitter = randomJitter
 	}
 	return delay + jitter(delay/2)
 }
 
+// randomJitter returns a uniformly random duration in [0, max].
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(max.Nanoseconds() + 1))
+}
+
 func waitRetry(ctx context.Context, delay time.Duration) error {
 	t := time.NewTimer(delay)
 	defer t.Stop()
@@ -152,83 +214,127 @@ func retryDelay(resp *http.Response, fallback time.Duration) time.Duration {
 }
 
 func (c *APIClient) getJSON(ctx context.Context, token, path string, out any) error {
-	url := strings.TrimRight(c.BaseURL, "/") + path
-	for i := 0; i <= c.MaxRetries; i++ {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	return c.doJSON(ctx, token, http.MethodGet, path, nil, out)
+}
+
+// doJSON sends an optional JSON body with retries and decodes the JSON response into out when non-nil.
+func (c *APIClient) doJSON(ctx context.Context, token, method, path string, body, out any) error {
+	if err := c.Breaker.allow(); err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	err := c.roundTrip(ctx, token, method, path, body, out)
+	c.Breaker.record(err)
+	c.recordAPIError(err)
+	return err
+}
+
+func (c *APIClient) roundTrip(ctx context.Context, token, method, path string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
 		if err != nil {
-			return fmt.Errorf("build request %s: %w", path, err)
+			return fmt.Errorf("encode %s: %w", path, err)
 		}
-		req.Header.Set("x-ztnet-auth", token)
-
-		resp, err := c.HTTPClient.Do(req)
+		payload = b
+	}
+	// wait backs off before the next attempt; a deadline hit while waiting is a timeout.
+	wait := func(base string, delay time.Duration) error {
+		err := waitRetry(ctx, delay)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return transportError(method, path, base, err)
+		}
+		return err
+	}
+	conditional := method == http.MethodGet
+	if vr, ok := out.(validatedResult); ok {
+		conditional = conditional && vr.conditional()
+	}
+	for i := 0; i <= c.MaxRetries; i++ {
+		resp, base, err := c.exchange(ctx, token, method, path, payload, conditional)
 		if err != nil {
-			if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
 				return ctx.Err()
 			}
-			if i == c.MaxRetries {
-				return fmt.Errorf("GET %s: %w", path, err)
+			if i == c.MaxRetries || ctx.Err() != nil {
+				return transportError(method, path, base, err)
 			}
-			if err := waitRetry(ctx, c.retryDelay(i)); err != nil {
+			if err := wait(base, c.retryDelay(i)); err != nil {
 				return err
 			}
 			continue
 		}
 
-		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		if resp.StatusCode == http.StatusNotModified {
 			_, _ = io.Copy(io.Discard, resp.Body)
 			_ = resp.Body.Close()
-			return ErrUnauthorized
+			return ErrNotModified
 		}
-		if resp.StatusCode == http.StatusTooManyRequests {
+		if resp.StatusCode >= 400 {
 			_, _ = io.Copy(io.Discard, resp.Body)
 			_ = resp.Body.Close()
-			if i == c.MaxRetries {
-				return fmt.Errorf("GET %s status %d after %d retries", path, resp.StatusCode, c.MaxRetries)
-			}
-			delay := retryDelay(resp, time.Duration(i+1)*100*time.Millisecond)
-			if err := waitRetry(ctx, delay); err != nil {
-				return err
+			apiErr := statusError(method, path, base, resp.StatusCode)
+			if !unavailable(apiErr) || i == c.MaxRetries {
+				return apiErr
 			}
-			continue
-		}
-		if resp.StatusCode >= 500 {
-			_, _ = io.Copy(io.Discard, resp.Body)
-			_ = resp.Body.Close()
-			if i == c.MaxRetries {
-				return fmt.Errorf("GET %s status %d", path, resp.StatusCode)
+			delay := c.retryDelay(i)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				delay = retryDelay(resp, time.Duration(i+1)*100*time.Millisecond)
 			}
-			if err := waitRetry(ctx, c.retryDelay(i)); err != nil {
+			if err := wait(base, delay); err != nil {
 				return err
 			}
 			continue
 		}
-		if resp.StatusCode >= 400 {
+		if out == nil {
 			_, _ = io.Copy(io.Discard, resp.Body)
 			_ = resp.Body.Close()
-			return fmt.Errorf("GET %s status %d", path, resp.StatusCode)
+			return nil
 		}
-		const maxResponseBody = 10 << 20
-		if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(out); err != nil {
-			_ = resp.Body.Close()
-			return fmt.Errorf("decode %s: %w", path, err)
+		body := &limitedBody{r: resp.Body, n: c.maxResponseBytes(), limit: c.maxResponseBytes()}
+		if dec, ok := out.(responseDecoder); ok {
+			err = dec.decodeResponse(resp, body)
+		} else {
+			err = json.NewDecoder(body).Decode(out)
 		}
 		_ = resp.Body.Close()
+		if err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			if ctx.Err() != nil {
+				return transportError(method, path, base, err)
+			}
+			return &APIError{Class: ErrDecode, Method: method, Path: path, Endpoint: base, Err: err}
+		}
+		if conditional {
+			c.storeValidator(path, resp, out)
+		}
 		return nil
 	}
 	return fmt.Errorf("retry loop exhausted")
 }
 
 func (c *APIClient) FetchMembers(ctx context.Context, token string) ([]Member, error) {
-	var members []Member
+	var out []Member
 	path := fmt.Sprintf("/api/v1/network/%s/member", c.NetworkID)
-	if err := c.getJSON(ctx, token, path, &members); err != nil {
-		return nil, fmt.Errorf("fetch members: %w", err)
-	}
-	out := make([]Member, 0, len(members))
-	for _, m := range members {
-		if m.Authorized {
-			out = append(out, m)
+	seen := map[string]bool{}
+	for page := 0; path != ""; page++ {
+		if page == maxMemberPages || seen[path] {
+			return nil, fmt.Errorf("fetch members: pagination did not end after %d pages", page)
 		}
+		seen[path] = true
+		m := memberPage{first: page == 0, path: path}
+		if err := c.getJSON(ctx, token, path, &m); err != nil {
+			if page > 0 && errors.Is(err, ErrNotModified) {
+				err = fmt.Errorf("page %d answered not modified", page+1)
+			}
+			return nil, fmt.Errorf("fetch members: %w", err)
+		}
+		out = append(out, m.members...)
+		path = m.next
+	}
+	if out == nil {
+		out = []Member{}
 	}
 	return out, nil
 }
@@ -241,3 +347,28 @@ func (c *APIClient) FetchNetwork(ctx context.Context, token string) (NetworkInfo
 	}
 	return n, nil
 }
+
+// ValidateToken checks token with a single unconditional network request, without
+// retries or touching the cached ETag/Last-Modified validators.
+func (c *APIClient) ValidateToken(ctx context.Context, token string) error {
+	method, path := http.MethodGet, fmt.Sprintf("/api/v1/network/%s", c.NetworkID)
+	resp, base, err := c.exchange(ctx, token, method, path, nil, false)
+	if err != nil {
+		return transportError(method, path, base, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return statusError(method, path, base, resp.StatusCode)
+	}
+	return nil
+}
+
+// UpdateMemberName renames a network member through the ZTNET API.
+func (c *APIClient) UpdateMemberName(ctx context.Context, token, nodeID, name string) error {
+	path := fmt.Sprintf("/api/v1/network/%s/member/%s", c.NetworkID, nodeID)
+	if err := c.doJSON(ctx, token, http.MethodPost, path, map[string]string{"name": name}, nil); err != nil {
+		return fmt.Errorf("update member %s: %w", nodeID, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package ztnet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// ErrCircuitOpen is returned without contacting the API while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Circuit breaker states, exported as coredns_ztnet_circuit_breaker_state.
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// BreakerConfig configures the API circuit breaker: Threshold consecutive
+// unavailability errors (see unavailable) open it for Cooldown. A zero Threshold disables it.
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// circuitBreaker stops calling an unavailable API. After Cooldown it lets
+// requests through again (half-open); a success closes it, a failure reopens it.
+type circuitBreaker struct {
+	zone string
+	cfg  BreakerConfig
+	now  func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(zone string, cfg BreakerConfig) *circuitBreaker {
+	b := &circuitBreaker{zone: zone, cfg: cfg, now: time.Now}
+	breakerGauge.WithLabelValues(zone).Set(breakerClosed)
+	return b
+}
+
+// allow reports ErrCircuitOpen while the breaker is open and the cooldown has not elapsed.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return nil
+	}
+	if b.now().Sub(b.openedAt) < b.cfg.Cooldown {
+		return ErrCircuitOpen
+	}
+	b.setState(breakerHalfOpen)
+	return nil
+}
+
+// record updates the breaker with the outcome of a call that allow let through.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !unavailable(err) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.failures = 0
+		if b.state != breakerClosed {
+			clog.Infof("ztnet: circuit breaker closed for zone %s", b.zone)
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.cfg.Threshold) {
+		clog.Warningf("ztnet: circuit breaker open for zone %s after %d consecutive failures, retrying in %s", b.zone, b.failures, b.cfg.Cooldown)
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	breakerGauge.WithLabelValues(b.zone).Set(float64(state))
+}
+
+// backoffDelay returns the wait before the next refresh: the base interval after a
+// success, doubled per consecutive failure with jitter, capped at max.
+func backoffDelay(base, max time.Duration, failures int, jitter func(time.Duration) time.Duration) time.Duration {
+	if failures <= 0 || base <= 0 {
+		return base
+	}
+	if max < base {
+		max = base
+	}
+	d := base
+	for i := 0; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if jitter != nil {
+		d += jitter(d / 4)
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
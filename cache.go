@@ -5,9 +5,24 @@ import (
 	"sync/atomic"
 )
 
+// MemberIdentity identifies the ZeroTier member that owns an assigned IP.
+type MemberIdentity struct {
+	NodeID string
+	Name   string
+	Tags   []string
+}
+
+// MemberIndex maps assigned IPs and record names back to their owning members.
+type MemberIndex struct {
+	ByIP   map[string]MemberIdentity
+	ByName map[string]MemberIdentity
+}
+
 type cacheSnapshot struct {
 	a       map[string][]net.IP
 	aaaa    map[string][]net.IP
+	members map[string]MemberIdentity
+	owners  map[string]MemberIdentity
 	allowed *AllowedNets
 	serial  uint32
 }
@@ -20,7 +35,7 @@ type RecordCache struct {
 // NewRecordCache creates an initialized cache with empty maps and nil allowlist.
 func NewRecordCache() *RecordCache {
 	rc := &RecordCache{}
-	rc.snap.Store(cacheSnapshot{a: map[string][]net.IP{}, aaaa: map[string][]net.IP{}, allowed: nil, serial: 1})
+	rc.snap.Store(cacheSnapshot{a: map[string][]net.IP{}, aaaa: map[string][]net.IP{}, members: map[string]MemberIdentity{}, owners: map[string]MemberIdentity{}, allowed: nil, serial: 1})
 	return rc
 }
 
@@ -37,10 +52,23 @@ func cloneRecords(in map[string][]net.IP) map[string][]net.IP {
 	return out
 }
 
+func cloneMembers(in map[string]MemberIdentity) map[string]MemberIdentity {
+	out := make(map[string]MemberIdentity, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
 // Set atomically publishes a new snapshot.
 func (r *RecordCache) Set(a, aaaa map[string][]net.IP, allowed *AllowedNets) {
+	r.SetWithMembers(a, aaaa, MemberIndex{}, allowed)
+}
+
+// SetWithMembers atomically publishes a new snapshot including the member index.
+func (r *RecordCache) SetWithMembers(a, aaaa map[string][]net.IP, idx MemberIndex, allowed *AllowedNets) {
 	prev := r.load()
-	next := cacheSnapshot{a: cloneRecords(a), aaaa: cloneRecords(aaaa), allowed: allowed, serial: prev.serial + 1}
+	next := cacheSnapshot{a: cloneRecords(a), aaaa: cloneRecords(aaaa), members: cloneMembers(idx.ByIP), owners: cloneMembers(idx.ByName), allowed: allowed, serial: prev.serial + 1}
 	r.snap.Store(next)
 }
 
@@ -53,6 +81,28 @@ func (r *RecordCache) LookupBoth(name string) ([]net.IP, []net.IP) {
 	return s.a[name], s.aaaa[name]
 }
 
+// LookupMember returns the member identity owning ip, if any.
+func (r *RecordCache) LookupMember(ip net.IP) (MemberIdentity, bool) {
+	if ip == nil {
+		return MemberIdentity{}, false
+	}
+	id, ok := r.load().members[memberIPKey(ip)]
+	return id, ok
+}
+
+// LookupOwner returns the member identity owning record name, if any.
+func (r *RecordCache) LookupOwner(name string) (MemberIdentity, bool) {
+	id, ok := r.load().owners[name]
+	return id, ok
+}
+
+func memberIPKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
 // IsAllowed returns source allow result, honoring strict_start when allowlist is nil.
 func (r *RecordCache) IsAllowed(ip net.IP, strictStart bool) bool {
 	s := r.load()
@@ -62,6 +112,16 @@ func (r *RecordCache) IsAllowed(ip net.IP, strictStart bool) bool {
 	return s.allowed.Contains(ip)
 }
 
+// IsAllowedNet is IsAllowed for a client prefix: it is allowed only when an
+// allowed CIDR covers the whole prefix.
+func (r *RecordCache) IsAllowedNet(n *net.IPNet, strictStart bool) bool {
+	s := r.load()
+	if s.allowed == nil {
+		return !strictStart
+	}
+	return s.allowed.ContainsNet(n)
+}
+
 func (r *RecordCache) Counts() (int, int) {
 	s := r.load()
 	return len(s.a), len(s.aaaa)
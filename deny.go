@@ -0,0 +1,90 @@
+package ztnet
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// Deny actions applied to queries from sources outside the allowlist.
+const (
+	DenyActionRefused  = "refused"
+	DenyActionNXDomain = "nxdomain"
+	DenyActionDrop     = "drop"
+	DenyActionEDE      = "ede"
+)
+
+// DenyConfig defines how denied queries are answered.
+type DenyConfig struct {
+	Action  string
+	EDECode uint16
+	EDEText string
+}
+
+// parseDenyAction parses `deny_action <refused|nxdomain|drop|ede> [code] [text...]` arguments.
+func parseDenyAction(args []string) (DenyConfig, error) {
+	d := DenyConfig{Action: strings.ToLower(args[0])}
+	switch d.Action {
+	case DenyActionRefused, DenyActionNXDomain, DenyActionDrop:
+		if len(args) > 1 {
+			return d, fmt.Errorf("%s takes no extra arguments", d.Action)
+		}
+	case DenyActionEDE:
+		d.EDECode = dns.ExtendedErrorCodeProhibited
+		if len(args) > 1 {
+			v, err := strconv.ParseUint(args[1], 10, 16)
+			if err != nil {
+				return d, fmt.Errorf("ede code: %w", err)
+			}
+			d.EDECode = uint16(v)
+		}
+		if len(args) > 2 {
+			d.EDEText = strings.Join(args[2:], " ")
+		}
+	default:
+		return d, fmt.Errorf("unknown action %s", args[0])
+	}
+	return d, nil
+}
+
+// deny answers a query from a disallowed source according to the configured deny action.
+func (p *ZtnetPlugin) deny(w dns.ResponseWriter, r *dns.Msg, qname string, qtype uint16, src net.IP) int {
+	action := p.cfg.Deny.Action
+	if action == "" {
+		action = DenyActionRefused
+	}
+	clog.Warningf("ztnet: denied query action=%s name=%s type=%d src=%v", action, qname, qtype, src)
+	deniedCount.WithLabelValues(p.zone, action).Inc()
+	if action == DenyActionDrop {
+		return dns.RcodeSuccess
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch action {
+	case DenyActionNXDomain:
+		m.Authoritative = true
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, p.soaRecord())
+	case DenyActionEDE:
+		m.Rcode = dns.RcodeRefused
+		// an OPT record may only be returned to clients that sent one.
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+			ede := &dns.EDNS0_EDE{InfoCode: p.cfg.Deny.EDECode, ExtraText: p.cfg.Deny.EDEText}
+			m.IsEdns0().Option = append(m.IsEdns0().Option, ede)
+		}
+	default:
+		m.Rcode = dns.RcodeRefused
+	}
+	_ = w.WriteMsg(m)
+	if m.Rcode == dns.RcodeRefused {
+		refusedCount.WithLabelValues(p.zone).Inc()
+	}
+	requestCount.WithLabelValues(p.zone, dns.RcodeToString[m.Rcode]).Inc()
+	return m.Rcode
+}
@@ -0,0 +1,156 @@
+package ztnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// endpoints lists the API base URLs in preference order: BaseURL first, then FallbackURLs.
+func (c *APIClient) endpoints() []string {
+	return append([]string{c.BaseURL}, c.FallbackURLs...)
+}
+
+// endpointOrder lists the endpoint indexes to try, starting with the last healthy one.
+func (c *APIClient) endpointOrder() []int {
+	n := len(c.FallbackURLs) + 1
+	c.endpointsMu.Lock()
+	active := c.active
+	c.endpointsMu.Unlock()
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, (active+i)%n)
+	}
+	return order
+}
+
+// markEndpoint counts the outcome of a request to endpoint i and remembers it as active on success.
+func (c *APIClient) markEndpoint(i int, ok bool) {
+	base := c.endpoints()[i]
+	if !ok {
+		apiCallCount.WithLabelValues(c.Zone, base, "error").Inc()
+		return
+	}
+	apiCallCount.WithLabelValues(c.Zone, base, "ok").Inc()
+	c.endpointsMu.Lock()
+	defer c.endpointsMu.Unlock()
+	if c.active != i {
+		clog.Infof("ztnet: switching API endpoint for zone %s to %s", c.Zone, base)
+		c.active = i
+	}
+}
+
+// endpointFailed reports answers that make the client fail over to the next endpoint.
+func endpointFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// exchange sends the request to the active endpoint and fails over to the others
+// on transport errors and 5xx answers. The last response or error is returned
+// with the endpoint that produced it.
+func (c *APIClient) exchange(ctx context.Context, token, method, path string, payload []byte, conditional bool) (*http.Response, string, error) {
+	var resp *http.Response
+	var err error
+	var base string
+	order := c.endpointOrder()
+	for n, i := range order {
+		base = c.endpoints()[i]
+		resp, err = c.send(ctx, base, token, method, path, payload, conditional)
+		failed := endpointFailed(resp, err)
+		if err == nil || ctx.Err() == nil {
+			c.markEndpoint(i, !failed)
+		}
+		if !failed || ctx.Err() != nil || n == len(order)-1 {
+			break
+		}
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+	return resp, base, err
+}
+
+// probe checks every endpoint other than the active one and switches back to the
+// most preferred endpoint that answers.
+func (c *APIClient) probe(ctx context.Context, token string) {
+	if len(c.FallbackURLs) == 0 {
+		return
+	}
+	c.endpointsMu.Lock()
+	active := c.active
+	c.endpointsMu.Unlock()
+	path := fmt.Sprintf("/api/v1/network/%s", c.NetworkID)
+	for i, base := range c.endpoints() {
+		if i == active {
+			continue
+		}
+		resp, err := c.send(ctx, base, token, http.MethodGet, path, nil, false)
+		if ctx.Err() != nil {
+			return
+		}
+		ok := !endpointFailed(resp, err) && resp.StatusCode < 400
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if !ok {
+			apiCallCount.WithLabelValues(c.Zone, base, "error").Inc()
+			continue
+		}
+		if i < active {
+			c.markEndpoint(i, true)
+			return
+		}
+		apiCallCount.WithLabelValues(c.Zone, base, "ok").Inc()
+	}
+}
+
+func (c *APIClient) send(ctx context.Context, base, token, method, path string, payload []byte, conditional bool) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestBase(base)+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("build request %s: %w", path, err)
+	}
+	req.Header.Set("x-ztnet-auth", token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if conditional {
+		v := c.validator(path)
+		if v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+	}
+	start := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiDuration.WithLabelValues(c.Zone, base, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// probeEndpoints health checks the API endpoints that are not in use.
+func (p *ZtnetPlugin) probeEndpoints(ctx context.Context) {
+	token, err := p.apiToken()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	p.api.probe(ctx, token)
+}
@@ -0,0 +1,119 @@
+package ztnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// API error classes. Errors returned by APIClient wrap one of them in an *APIError,
+// so callers can test the class with errors.Is.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrNotFound     = errors.New("not found")
+	ErrServer       = errors.New("server error")
+	ErrClient       = errors.New("client error")
+	ErrDecode       = errors.New("decode error")
+	ErrTimeout      = errors.New("timeout")
+	ErrTransport    = errors.New("transport error")
+)
+
+// errorClasses maps error classes to their coredns_ztnet_api_errors_total label.
+var errorClasses = map[error]string{
+	ErrUnauthorized: "unauthorized",
+	ErrRateLimited:  "rate_limited",
+	ErrNotFound:     "not_found",
+	ErrServer:       "server",
+	ErrClient:       "client",
+	ErrDecode:       "decode",
+	ErrTimeout:      "timeout",
+	ErrTransport:    "transport",
+}
+
+// APIError describes a failed ZTNET API call.
+type APIError struct {
+	Class    error
+	Method   string
+	Path     string
+	Endpoint string
+	// Status is the HTTP status code, or 0 when no response was received.
+	Status int
+	Err    error
+}
+
+func (e *APIError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s %s status %d: %v", e.Method, e.Path, e.Status, e.Class)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *APIError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Class}
+	}
+	return []error{e.Class, e.Err}
+}
+
+// statusError classifies an HTTP error status.
+func statusError(method, path, endpoint string, status int) *APIError {
+	class := ErrClient
+	switch {
+	case status == 401 || status == 403:
+		class = ErrUnauthorized
+	case status == 404:
+		class = ErrNotFound
+	case status == 429:
+		class = ErrRateLimited
+	case status >= 500:
+		class = ErrServer
+	}
+	return &APIError{Class: class, Method: method, Path: path, Endpoint: endpoint, Status: status}
+}
+
+// transportError classifies a request that got no response.
+func transportError(method, path, endpoint string, err error) *APIError {
+	class := ErrTransport
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		class = ErrTimeout
+	}
+	return &APIError{Class: class, Method: method, Path: path, Endpoint: endpoint, Err: err}
+}
+
+// unavailable reports errors that suggest the API is down rather than rejecting the request.
+func unavailable(err error) bool {
+	return errors.Is(err, ErrServer) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrTransport)
+}
+
+// unauthorized reports whether any of errs is an ErrUnauthorized rejection.
+func unauthorized(errs ...error) bool {
+	for _, err := range errs {
+		if errors.Is(err, ErrUnauthorized) {
+			return true
+		}
+	}
+	return false
+}
+
+// answered reports whether any of errs comes with an API response, so the token that
+// made the request was accepted: it is nil or an error other than an outage, an open
+// circuit breaker or a canceled request.
+func answered(errs ...error) bool {
+	for _, err := range errs {
+		if err == nil || !(unavailable(err) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAPIError counts err in coredns_ztnet_api_errors_total when it is an *APIError.
+func (c *APIClient) recordAPIError(err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		apiErrCount.WithLabelValues(c.Zone, apiErr.Endpoint, errorClasses[apiErr.Class]).Inc()
+	}
+}
@@ -0,0 +1,85 @@
+package ztnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// httpService is an optional plugin-owned HTTP listener. It is released before a
+// Corefile reload so the next instance can bind the same address, and restored
+// if the reload fails.
+type httpService struct {
+	name    string
+	addr    string
+	handler http.Handler
+
+	mu  sync.Mutex
+	srv *http.Server
+}
+
+// httpAddrsKey stores the listener addresses claimed by the server blocks of one Corefile load.
+type httpAddrsKey struct{}
+
+// claimHTTPAddr rejects a listener address that another ztnet listener of the same
+// Corefile already uses, instead of failing later with "address already in use".
+func claimHTTPAddr(c *caddy.Controller, name, addr string) error {
+	claimed, _ := c.Get(httpAddrsKey{}).(map[string]string)
+	if claimed == nil {
+		claimed = map[string]string{}
+		c.Set(httpAddrsKey{}, claimed)
+	}
+	if prev, ok := claimed[addr]; ok {
+		return fmt.Errorf("%s address %s is already used by another ztnet %s listener; give each server block its own address", name, addr, prev)
+	}
+	claimed[addr] = name
+	return nil
+}
+
+func (h *httpService) register(c *caddy.Controller) {
+	c.OnStartup(h.startup)
+	c.OnRestart(h.shutdown)
+	c.OnRestartFailed(h.startup)
+	c.OnFinalShutdown(h.shutdown)
+}
+
+func (h *httpService) startup() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.srv != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h.handler, ReadHeaderTimeout: 5 * time.Second}
+	h.srv = srv
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			clog.Errorf("ztnet: %s listener on %s: %v", h.name, h.addr, err)
+		}
+	}()
+	clog.Infof("ztnet: %s listening on %s", h.name, ln.Addr())
+	return nil
+}
+
+func (h *httpService) shutdown() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := h.srv.Shutdown(ctx)
+	h.srv = nil
+	return err
+}
@@ -0,0 +1,187 @@
+package ztnet
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// pollerKey identifies instances that can share one refresh loop and cache: the same
+// API endpoint, network and token source plus every setting that shapes a snapshot.
+type pollerKey struct {
+	apiURL          string
+	networkID       string
+	tokenSource     string
+	tokenValue      string
+	commandTTL      time.Duration
+	commandTimeout  time.Duration
+	zone            string
+	allowed         string
+	autoAllowZT     bool
+	aclMode         string
+	refresh         time.Duration
+	timeout         time.Duration
+	maxRetries      int
+	breaker         BreakerConfig
+	maxBackoff      time.Duration
+	probeInterval   time.Duration
+	maxResponseSize int64
+	debounce        time.Duration
+	tls             TLSConfig
+	proxy           string
+	secondary       string
+}
+
+// sharedPoller is a process-wide refresh loop owned by the first instance that
+// started it and reference counted by every instance serving from its cache.
+type sharedPoller struct {
+	owner *ZtnetPlugin
+	refs  int
+}
+
+var (
+	pollersMu sync.Mutex
+	pollers   = map[pollerKey]*sharedPoller{}
+	// pending lists the instances that joined a poller during a Corefile load that
+	// has not completed yet. Caddy discards the new instance of a failed reload
+	// without calling its OnShutdown, so the old instance releases them instead.
+	pending []*ZtnetPlugin
+)
+
+func (p *ZtnetPlugin) pollerKey() pollerKey {
+	return pollerKey{
+		apiURL:          strings.Join(append([]string{p.cfg.APIURL}, p.cfg.APIFallbackURLs...), ","),
+		networkID:       p.cfg.NetworkID,
+		tokenSource:     p.cfg.Token.Source,
+		tokenValue:      p.cfg.Token.Value,
+		commandTTL:      p.cfg.Token.CommandTTL,
+		commandTimeout:  p.cfg.Token.CommandTimeout,
+		zone:            p.zone,
+		allowed:         strings.Join(p.cfg.AllowedCIDRs, ","),
+		autoAllowZT:     p.cfg.AutoAllowZT,
+		aclMode:         p.cfg.ACLMode,
+		refresh:         p.cfg.Refresh,
+		timeout:         p.cfg.Timeout,
+		maxRetries:      p.cfg.MaxRetries,
+		breaker:         p.cfg.Breaker,
+		maxBackoff:      p.cfg.MaxBackoff,
+		probeInterval:   p.cfg.APIProbeInterval,
+		maxResponseSize: p.cfg.MaxResponseSize,
+		debounce:        p.cfg.Webhook.Debounce,
+		tls:             p.cfg.TLS,
+		proxy:           p.cfg.APIProxy,
+		secondary:       p.cfg.SecondaryToken.Source + ":" + p.cfg.SecondaryToken.Value,
+	}
+}
+
+// poller returns the instance whose refresh loop feeds p's cache.
+func (p *ZtnetPlugin) poller() *ZtnetPlugin {
+	if p.source != nil {
+		return p.source
+	}
+	return p
+}
+
+// startup joins the shared poller for p's key, starting it if p is the first user, and
+// honours wait_for_sync. It runs from OnStartup, before servers accept queries. On a
+// Corefile reload the new instance joins before the old one leaves, so the loop and
+// its snapshot carry over unchanged. When the reload changed the poller settings, the
+// new loop starts from the snapshot of a running poller for the same zone and network.
+// If the reload fails, releasePending undoes the join.
+func (p *ZtnetPlugin) startup() error {
+	key := p.pollerKey()
+	pollersMu.Lock()
+	sp := pollers[key]
+	if sp == nil {
+		if prev := p.previousPoller(); prev != nil {
+			p.cache.snap.Store(prev.cache.load())
+			p.status.mu.Lock()
+			p.status.state = prev.status.get()
+			p.status.mu.Unlock()
+			clog.Infof("ztnet: zone %s reusing snapshot serial %d from previous instance", p.zone, p.cache.Serial())
+		}
+		sp = &sharedPoller{owner: p}
+		pollers[key] = sp
+	}
+	sp.refs++
+	p.joined = true
+	pending = append(pending, p)
+	pollersMu.Unlock()
+
+	if sp.owner == p {
+		p.start(context.Background())
+	} else {
+		p.source = sp.owner
+		p.cache = sp.owner.cache
+		clog.Infof("ztnet: zone %s sharing refresh loop at snapshot serial %d", p.zone, p.cache.Serial())
+	}
+	if err := p.waitForSync(); err != nil {
+		_ = p.shutdown()
+		return err
+	}
+	return nil
+}
+
+// commitPending forgets the pending instances once a Corefile load has started all
+// its servers; from then on their own OnShutdown releases them.
+func commitPending(event caddy.EventName, _ interface{}) error {
+	if event == caddy.InstanceStartupEvent {
+		pollersMu.Lock()
+		pending = nil
+		pollersMu.Unlock()
+	}
+	return nil
+}
+
+// releasePending leaves the pollers joined by the instances of a failed reload, so a
+// loop started for changed settings stops and shared loops drop their references.
+// It runs from OnRestartFailed of the instance that stays in service.
+func releasePending() error {
+	pollersMu.Lock()
+	failed := pending
+	pending = nil
+	pollersMu.Unlock()
+	for _, p := range failed {
+		_ = p.shutdown()
+	}
+	return nil
+}
+
+// previousPoller returns the owner of a running poller serving p's zone and network
+// from the same primary api_url. pollersMu must be held.
+func (p *ZtnetPlugin) previousPoller() *ZtnetPlugin {
+	for _, sp := range pollers {
+		o := sp.owner
+		if o.zone == p.zone && o.cfg.NetworkID == p.cfg.NetworkID && o.cfg.APIURL == p.cfg.APIURL {
+			return o
+		}
+	}
+	return nil
+}
+
+// shutdown leaves the shared poller and stops its loop when p was the last user.
+func (p *ZtnetPlugin) shutdown() error {
+	key := p.pollerKey()
+	pollersMu.Lock()
+	sp := pollers[key]
+	if !p.joined || sp == nil {
+		pollersMu.Unlock()
+		return nil
+	}
+	p.joined = false
+	sp.refs--
+	last := sp.refs == 0
+	if last {
+		delete(pollers, key)
+	}
+	pollersMu.Unlock()
+
+	if last {
+		sp.owner.stop()
+	}
+	return nil
+}
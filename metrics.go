@@ -10,8 +10,21 @@ import (
 var (
 	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_requests_total", Help: "DNS requests handled"}, []string{"zone", "rcode"})
 	refusedCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_refused_total", Help: "REFUSED responses"}, []string{"zone"})
+	deniedCount  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_denied_total", Help: "Denied queries by deny action"}, []string{"zone", "action"})
+	limitedCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_ratelimited_total", Help: "Rate limited queries by action"}, []string{"zone", "action"})
+	tsigCount    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_tsig_total", Help: "TSIG signed queries by key and verification status"}, []string{"zone", "key", "status"})
+	updateCount  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_updates_total", Help: "Dynamic update requests by rcode"}, []string{"zone", "rcode"})
+	webhookCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_webhook_total", Help: "Webhook calls by status"}, []string{"zone", "status"})
 	refreshCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_cache_refresh_total", Help: "Refresh attempts"}, []string{"zone", "status"})
 	entriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "coredns_ztnet_cache_entries", Help: "Cache entry count"}, []string{"zone", "type"})
+	lastOKGauge  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "coredns_ztnet_last_refresh_timestamp_seconds", Help: "Unix time of the last successful refresh"}, []string{"zone"})
+	healthGauge  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "coredns_ztnet_degraded", Help: "1 when the snapshot is older than stale_threshold"}, []string{"zone"})
+	breakerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "coredns_ztnet_circuit_breaker_state", Help: "API circuit breaker state: 0 closed, 1 half-open, 2 open"}, []string{"zone"})
+	apiCallCount = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_api_endpoint_requests_total", Help: "ZTNET API requests by endpoint and status"}, []string{"zone", "endpoint", "status"})
+	apiErrCount  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_api_errors_total", Help: "Failed ZTNET API calls by endpoint and error class"}, []string{"zone", "endpoint", "class"})
+	apiDuration  = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "coredns_ztnet_api_request_duration_seconds", Help: "ZTNET API HTTP request duration by endpoint and status code", Buckets: prometheus.DefBuckets}, []string{"zone", "endpoint", "code"})
+	tokenMtime   = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "coredns_ztnet_token_file_last_change_timestamp_seconds", Help: "Modification time of token_file"}, []string{"zone"})
+	tokenAuth    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_token_auth_total", Help: "Refresh authentication results by token (primary or secondary)"}, []string{"zone", "token", "status"})
 	tokenReload  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "coredns_ztnet_token_reload_total", Help: "Token reload attempts"}, []string{"zone", "source", "status"})
 )
 
@@ -23,9 +36,22 @@ func init() {
 func registerMetrics(registry prometheus.Registerer) {
 	registerCollector(registry, requestCount)
 	registerCollector(registry, refusedCount)
+	registerCollector(registry, deniedCount)
+	registerCollector(registry, limitedCount)
+	registerCollector(registry, tsigCount)
+	registerCollector(registry, updateCount)
+	registerCollector(registry, webhookCount)
 	registerCollector(registry, refreshCount)
 	registerCollector(registry, entriesGauge)
+	registerCollector(registry, lastOKGauge)
+	registerCollector(registry, healthGauge)
+	registerCollector(registry, breakerGauge)
+	registerCollector(registry, apiCallCount)
+	registerCollector(registry, apiErrCount)
+	registerCollector(registry, apiDuration)
 	registerCollector(registry, tokenReload)
+	registerCollector(registry, tokenMtime)
+	registerCollector(registry, tokenAuth)
 }
 
 func registerCollector(registry prometheus.Registerer, collector prometheus.Collector) {
@@ -0,0 +1,123 @@
+package ztnet
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets caps the tracked source prefixes; the least recently seen bucket is evicted first.
+const maxRateBuckets = 10000
+
+// RateLimitConfig defines the per-source token bucket applied to in-zone queries.
+type RateLimitConfig struct {
+	Rate       float64
+	Burst      int
+	IPv4Prefix int
+	IPv6Prefix int
+	Slip       int
+}
+
+type rateBucket struct {
+	key     string
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// rateLimiter is a token-bucket limiter keyed by source prefix.
+type rateLimiter struct {
+	cfg     RateLimitConfig
+	v4Mask  net.IPMask
+	v6Mask  net.IPMask
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// recent orders the buckets from most to least recently seen.
+	recent *list.List
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:     cfg,
+		v4Mask:  net.CIDRMask(cfg.IPv4Prefix, 32),
+		v6Mask:  net.CIDRMask(cfg.IPv6Prefix, 128),
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// parseRateLimit parses `rate_limit <qps> [burst]` arguments.
+func parseRateLimit(args []string, cfg *RateLimitConfig) error {
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return fmt.Errorf("rate: %w", err)
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return fmt.Errorf("rate must be > 0, got %s", args[0])
+	}
+	cfg.Rate = rate
+	cfg.Burst = int(math.Ceil(rate))
+	if len(args) > 1 {
+		burst, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("burst: %w", err)
+		}
+		if burst < 1 {
+			return fmt.Errorf("burst must be >= 1, got %d", burst)
+		}
+		cfg.Burst = burst
+	}
+	return nil
+}
+
+func (l *rateLimiter) key(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(l.v4Mask).String()
+	}
+	return ip.Mask(l.v6Mask).String()
+}
+
+// allow consumes a token for ip. When the bucket is empty it reports whether this
+// limited query should slip through as a truncated answer instead of being dropped.
+func (l *rateLimiter) allow(ip net.IP) (ok, slip bool) {
+	if ip == nil || ip.IsLoopback() {
+		return true, false
+	}
+	now := l.now()
+	k := l.key(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(k, now)
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	b.limited++
+	return false, l.cfg.Slip > 0 && b.limited%uint64(l.cfg.Slip) == 0
+}
+
+// bucket returns the bucket for k, marking it as most recently seen. A new
+// bucket evicts the least recently seen one once maxRateBuckets is reached.
+func (l *rateLimiter) bucket(k string, now time.Time) *rateBucket {
+	if e := l.buckets[k]; e != nil {
+		l.recent.MoveToFront(e)
+		return e.Value.(*rateBucket)
+	}
+	if l.recent.Len() >= maxRateBuckets {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*rateBucket).key)
+	}
+	b := &rateBucket{key: k, tokens: float64(l.cfg.Burst), last: now}
+	l.buckets[k] = l.recent.PushFront(b)
+	return b
+}
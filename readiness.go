@@ -0,0 +1,72 @@
+package ztnet
+
+import (
+	"fmt"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Ready implements ready.Readiness: the plugin is ready once a refresh has succeeded,
+// so the ready plugin does not report OK while the cache is still empty.
+func (p *ZtnetPlugin) Ready() bool {
+	return !p.poller().status.get().lastOK.IsZero()
+}
+
+// Degraded reports whether the served snapshot is older than stale_threshold.
+func (p *ZtnetPlugin) Degraded() bool {
+	if p.cfg.StaleThreshold <= 0 {
+		return false
+	}
+	last := p.poller().status.get().lastOK
+	return last.IsZero() || time.Since(last) > p.cfg.StaleThreshold
+}
+
+// checkHealth publishes the degraded signal and logs transitions.
+func (p *ZtnetPlugin) checkHealth() {
+	st := p.status.get()
+	if !st.lastOK.IsZero() {
+		lastOKGauge.WithLabelValues(p.zone).Set(float64(st.lastOK.Unix()))
+	}
+	degraded := p.Degraded()
+	v := 0.0
+	if degraded {
+		v = 1
+	}
+	healthGauge.WithLabelValues(p.zone).Set(v)
+	if p.degraded.Swap(degraded) == degraded {
+		return
+	}
+	if degraded {
+		clog.Warningf("ztnet: zone %s degraded: snapshot older than %s (last error: %s)", p.zone, p.cfg.StaleThreshold, st.lastErr)
+		return
+	}
+	clog.Infof("ztnet: zone %s recovered from degraded state", p.zone)
+}
+
+const syncPollInterval = 50 * time.Millisecond
+
+// waitForSync blocks until the first successful refresh or until wait_for_sync expires.
+// On timeout it fails startup, or only warns when wait_for_sync is in warn mode.
+func (p *ZtnetPlugin) waitForSync() error {
+	if p.cfg.WaitForSync <= 0 {
+		return nil
+	}
+	deadline := time.NewTimer(p.cfg.WaitForSync)
+	defer deadline.Stop()
+	tick := time.NewTicker(syncPollInterval)
+	defer tick.Stop()
+	for !p.Ready() {
+		select {
+		case <-deadline.C:
+			err := fmt.Errorf("zone %s not synced after %s: %s", p.zone, p.cfg.WaitForSync, p.poller().status.get().lastErr)
+			if p.cfg.WaitForSyncWarn {
+				clog.Warningf("ztnet: %v; starting with empty cache", err)
+				return nil
+			}
+			return err
+		case <-tick.C:
+		}
+	}
+	return nil
+}
@@ -1,21 +1,66 @@
 package ztnet
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	TokenSourceFile   = "file"
-	TokenSourceEnv    = "env"
-	TokenSourceInline = "inline"
+	TokenSourceFile       = "file"
+	TokenSourceEnv        = "env"
+	TokenSourceInline     = "inline"
+	TokenSourceCredential = "credential"
+	TokenSourceCommand    = "command"
 )
 
-// TokenConfig defines token source and source value.
+// TokenConfig defines token source and source value. For the command source,
+// Value is the command line for display and Command holds its argv.
 type TokenConfig struct {
 	Source string
 	Value  string
+
+	Command        []string
+	CommandTTL     time.Duration
+	CommandTimeout time.Duration
+}
+
+// commandWaitDelay bounds how long a killed token_command may keep its output open
+// through processes it started.
+const commandWaitDelay = 100 * time.Millisecond
+
+// commandToken is a token_command output cached until expires.
+type commandToken struct {
+	token   string
+	expires time.Time
+}
+
+var (
+	commandTokensMu sync.Mutex
+	// commandTokens is keyed by commandKey.
+	commandTokens = map[string]commandToken{}
+)
+
+// commandKey identifies a token_command by its argv.
+func commandKey(cfg TokenConfig) string {
+	return strings.Join(cfg.Command, "\x00")
+}
+
+// forgetCommandToken drops the cached output of a token_command, so the next
+// LoadToken runs it again. Other sources are not cached.
+func forgetCommandToken(cfg TokenConfig) {
+	if cfg.Source != TokenSourceCommand {
+		return
+	}
+	commandTokensMu.Lock()
+	delete(commandTokens, commandKey(cfg))
+	commandTokensMu.Unlock()
 }
 
 // LoadToken resolves token from file/env/inline config.
@@ -43,7 +88,58 @@ func LoadToken(cfg TokenConfig) (string, error) {
 			return "", fmt.Errorf("api_token empty")
 		}
 		return t, nil
+	case TokenSourceCredential:
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("token_credential %s: CREDENTIALS_DIRECTORY is not set", cfg.Value)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, cfg.Value))
+		if err != nil {
+			return "", fmt.Errorf("token_credential read: %w", err)
+		}
+		t := strings.TrimSpace(string(b))
+		if t == "" {
+			return "", fmt.Errorf("token_credential empty: %s", cfg.Value)
+		}
+		return t, nil
+	case TokenSourceCommand:
+		return commandTokenFor(cfg)
 	default:
 		return "", fmt.Errorf("unknown token source: %s", cfg.Source)
 	}
 }
+
+// commandTokenFor runs token_command, reusing its output for CommandTTL.
+func commandTokenFor(cfg TokenConfig) (string, error) {
+	key := commandKey(cfg)
+	commandTokensMu.Lock()
+	cached, ok := commandTokens[key]
+	commandTokensMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CommandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stderr = &stderr
+	// a child left running by a killed command (sh -c) must not hold Output open.
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("token_command timed out after %s", cfg.CommandTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("token_command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	t := strings.TrimSpace(string(out))
+	if t == "" {
+		return "", fmt.Errorf("token_command returned an empty token")
+	}
+	if cfg.CommandTTL > 0 {
+		commandTokensMu.Lock()
+		commandTokens[key] = commandToken{token: t, expires: time.Now().Add(cfg.CommandTTL)}
+		commandTokensMu.Unlock()
+	}
+	return t, nil
+}
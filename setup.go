@@ -1,7 +1,6 @@
 package ztnet
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -12,39 +11,68 @@ import (
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/miekg/dns"
 )
 
-func init() { plugin.Register("ztnet", setup) }
+func init() {
+	plugin.Register("ztnet", setup)
+	caddy.RegisterEventHook("ztnet", commitPending)
+}
 
 func setup(c *caddy.Controller) error {
 	cfg, err := parse(c)
 	if err != nil {
 		return plugin.Error("ztnet", err)
 	}
-	tr := &http.Transport{
-		DialContext:           (&net.Dialer{Timeout: cfg.Timeout / 2}).DialContext,
-		TLSHandshakeTimeout:   cfg.Timeout / 2,
-		ResponseHeaderTimeout: cfg.Timeout,
-		IdleConnTimeout:       90 * time.Second,
+	tr, err := newAPITransport(cfg)
+	if err != nil {
+		return plugin.Error("ztnet", err)
+	}
+	p := &ZtnetPlugin{zone: cfg.Zone, cfg: cfg, cache: NewRecordCache(), api: &APIClient{BaseURL: cfg.APIURL, NetworkID: cfg.NetworkID, HTTPClient: &http.Client{Transport: tr, Timeout: cfg.Timeout}, MaxRetries: cfg.MaxRetries, FallbackURLs: cfg.APIFallbackURLs, Zone: cfg.Zone, MaxResponseBytes: cfg.MaxResponseSize}}
+	if cfg.Breaker.Threshold > 0 {
+		p.api.Breaker = newCircuitBreaker(cfg.Zone, cfg.Breaker)
+	}
+	p.trigger = make(chan struct{}, 1)
+	if cfg.Webhook.Addr != "" {
+		if err := claimHTTPAddr(c, "webhook", cfg.Webhook.Addr); err != nil {
+			return plugin.Error("ztnet", err)
+		}
+		(&httpService{name: "webhook", addr: cfg.Webhook.Addr, handler: p.webhookHandler()}).register(c)
+	}
+	if cfg.Admin.Addr != "" {
+		if err := claimHTTPAddr(c, "admin", cfg.Admin.Addr); err != nil {
+			return plugin.Error("ztnet", err)
+		}
+		(&httpService{name: "admin", addr: cfg.Admin.Addr, handler: p.adminHandler()}).register(c)
+	}
+	if cfg.RateLimit.Rate > 0 {
+		p.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	if len(cfg.TSIGKeys) > 0 {
+		// the server verifies request MACs and signs responses with its secrets.
+		config := dnsserver.GetConfig(c)
+		if config.TsigSecret == nil {
+			config.TsigSecret = make(map[string]string, len(cfg.TSIGKeys))
+		}
+		for name, secret := range cfg.TSIGKeys {
+			config.TsigSecret[name] = secret
+		}
 	}
-	p := &ZtnetPlugin{zone: cfg.Zone, cfg: cfg, cache: NewRecordCache(), api: &APIClient{BaseURL: cfg.APIURL, NetworkID: cfg.NetworkID, HTTPClient: &http.Client{Transport: tr, Timeout: cfg.Timeout}, MaxRetries: cfg.MaxRetries}}
-	p.start(context.Background())
+	c.OnStartup(p.startup)
+	c.OnShutdown(p.shutdown)
+	c.OnRestartFailed(releasePending)
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		p.Next = next
 		return p
 	})
-	c.OnFinalShutdown(func() error {
-		p.stop()
-		return nil
-	})
 	clog.Infof("ztnet: configured zone %s (version %s)", cfg.Zone, PluginVersion)
 	return nil
 }
 
 func parse(c *caddy.Controller) (Config, error) {
-	cfg := Config{TTL: 60, Refresh: 30 * time.Second, Timeout: 5 * time.Second, MaxRetries: 3, AutoAllowZT: true}
+	cfg := Config{Token: TokenConfig{CommandTTL: 5 * time.Minute, CommandTimeout: 10 * time.Second}, TTL: 60, Refresh: 30 * time.Second, Timeout: 5 * time.Second, MaxRetries: 3, AutoAllowZT: true, ACLMode: ACLModeNetworks, Deny: DenyConfig{Action: DenyActionRefused}, RateLimit: RateLimitConfig{IPv4Prefix: 32, IPv6Prefix: 128, Slip: 2}, Webhook: WebhookConfig{Debounce: 2 * time.Second}, Breaker: BreakerConfig{Threshold: 5, Cooldown: 30 * time.Second}, MaxBackoff: 5 * time.Minute, APIProbeInterval: time.Minute, MaxResponseSize: defaultMaxResponseBytes}
 	tokenSources := 0
 	for c.Next() {
 		for c.NextBlock() {
@@ -55,27 +83,211 @@ func parse(c *caddy.Controller) (Config, error) {
 			}
 			switch k {
 			case "api_url":
-				cfg.APIURL = args[0]
+				// repeated or multi-value api_url lines add fallback endpoints in order.
+				if cfg.APIURL == "" {
+					cfg.APIURL, args = args[0], args[1:]
+				}
+				cfg.APIFallbackURLs = append(cfg.APIFallbackURLs, args...)
+			case "api_proxy":
+				if err := parseAPIProxy(args[0]); err != nil {
+					return cfg, fmt.Errorf("api_proxy parse: %w", err)
+				}
+				cfg.APIProxy = args[0]
+			case "max_response_size":
+				v, err := parseByteSize(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("max_response_size parse: %w", err)
+				}
+				cfg.MaxResponseSize = v
+			case "api_probe_interval":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("api_probe_interval parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("api_probe_interval must be >= 0, got %s", v)
+				}
+				cfg.APIProbeInterval = v
 			case "network_id":
 				cfg.NetworkID = args[0]
 			case "zone":
 				cfg.Zone = dns.Fqdn(strings.ToLower(args[0]))
 			case "token_file":
 				tokenSources++
-				cfg.Token = TokenConfig{Source: TokenSourceFile, Value: args[0]}
+				cfg.Token.Source, cfg.Token.Value = TokenSourceFile, args[0]
 			case "token_env":
 				tokenSources++
-				cfg.Token = TokenConfig{Source: TokenSourceEnv, Value: args[0]}
+				cfg.Token.Source, cfg.Token.Value = TokenSourceEnv, args[0]
 			case "api_token":
 				tokenSources++
-				cfg.Token = TokenConfig{Source: TokenSourceInline, Value: args[0]}
+				cfg.Token.Source, cfg.Token.Value = TokenSourceInline, args[0]
 				clog.Warning("ztnet: using inline api_token is for development only")
+			case "token_credential":
+				if strings.ContainsRune(args[0], '/') {
+					return cfg, fmt.Errorf("token_credential must be a credential name, got %s", args[0])
+				}
+				tokenSources++
+				cfg.Token.Source, cfg.Token.Value = TokenSourceCredential, args[0]
+			case "token_command":
+				tokenSources++
+				cfg.Token.Source, cfg.Token.Value, cfg.Token.Command = TokenSourceCommand, strings.Join(args, " "), args
+			case "token_secondary":
+				if len(args) < 2 {
+					return cfg, fmt.Errorf("token_secondary requires a source and value")
+				}
+				switch args[0] {
+				case TokenSourceFile, TokenSourceEnv, TokenSourceInline:
+					cfg.SecondaryToken = TokenConfig{Source: args[0], Value: args[1]}
+				case TokenSourceCredential:
+					if strings.ContainsRune(args[1], '/') {
+						return cfg, fmt.Errorf("token_secondary credential must be a credential name, got %s", args[1])
+					}
+					cfg.SecondaryToken = TokenConfig{Source: args[0], Value: args[1]}
+				case TokenSourceCommand:
+					cfg.SecondaryToken = TokenConfig{Source: args[0], Value: strings.Join(args[1:], " "), Command: args[1:]}
+				default:
+					return cfg, fmt.Errorf("token_secondary source must be file, env, credential, command or inline, got %s", args[0])
+				}
+			case "token_command_ttl", "token_command_timeout":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("%s parse: %w", k, err)
+				}
+				if v < 0 || (v == 0 && k == "token_command_timeout") {
+					return cfg, fmt.Errorf("%s must be positive, got %s", k, v)
+				}
+				if k == "token_command_ttl" {
+					cfg.Token.CommandTTL = v
+				} else {
+					cfg.Token.CommandTimeout = v
+				}
 			case "auto_allow_zt":
 				v, err := strconv.ParseBool(args[0])
 				if err != nil {
 					return cfg, fmt.Errorf("auto_allow_zt parse: %w", err)
 				}
 				cfg.AutoAllowZT = v
+			case "acl_mode":
+				switch args[0] {
+				case ACLModeNetworks, ACLModeMembers:
+					cfg.ACLMode = args[0]
+				default:
+					return cfg, fmt.Errorf("acl_mode must be %s or %s, got %s", ACLModeNetworks, ACLModeMembers, args[0])
+				}
+			case "deny_action":
+				d, err := parseDenyAction(args)
+				if err != nil {
+					return cfg, fmt.Errorf("deny_action parse: %w", err)
+				}
+				cfg.Deny = d
+			case "rate_limit":
+				if err := parseRateLimit(args, &cfg.RateLimit); err != nil {
+					return cfg, fmt.Errorf("rate_limit parse: %w", err)
+				}
+			case "rate_limit_prefix":
+				if len(args) != 2 {
+					return cfg, fmt.Errorf("rate_limit_prefix requires ipv4 and ipv6 prefix lengths")
+				}
+				v4, err4 := strconv.Atoi(args[0])
+				v6, err6 := strconv.Atoi(args[1])
+				if err4 != nil || err6 != nil || v4 < 0 || v4 > 32 || v6 < 0 || v6 > 128 {
+					return cfg, fmt.Errorf("rate_limit_prefix must be 0-32 and 0-128, got %s %s", args[0], args[1])
+				}
+				cfg.RateLimit.IPv4Prefix, cfg.RateLimit.IPv6Prefix = v4, v6
+			case "rate_limit_slip":
+				v, err := strconv.Atoi(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("rate_limit_slip parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("rate_limit_slip must be >= 0, got %d", v)
+				}
+				cfg.RateLimit.Slip = v
+			case "trusted_forwarders":
+				nets, err := parseCIDRs(args)
+				if err != nil {
+					return cfg, fmt.Errorf("trusted_forwarders parse: %w", err)
+				}
+				cfg.TrustedForwarders = append(cfg.TrustedForwarders, nets...)
+			case "trusted_proxies":
+				nets, err := parseCIDRs(args)
+				if err != nil {
+					return cfg, fmt.Errorf("trusted_proxies parse: %w", err)
+				}
+				cfg.TrustedProxies = append(cfg.TrustedProxies, nets...)
+			case "client_ip_metadata":
+				if !metadata.IsLabel(args[0]) {
+					return cfg, fmt.Errorf("client_ip_metadata must be a <plugin>/<name> label, got %s", args[0])
+				}
+				cfg.ClientIPMetadata = args[0]
+			case "tsig_key":
+				name, secret, err := parseTSIGKey(args)
+				if err != nil {
+					return cfg, fmt.Errorf("tsig_key parse: %w", err)
+				}
+				if cfg.TSIGKeys == nil {
+					cfg.TSIGKeys = make(map[string]string)
+				}
+				cfg.TSIGKeys[name] = secret
+			case "dynamic_updates":
+				v, err := strconv.ParseBool(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("dynamic_updates parse: %w", err)
+				}
+				cfg.DynamicUpdates = v
+			case "webhook":
+				if len(args) != 2 {
+					return cfg, fmt.Errorf("webhook requires listen address and secret file")
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return cfg, fmt.Errorf("webhook parse: %w", err)
+				}
+				cfg.Webhook.Addr, cfg.Webhook.SecretFile = args[0], args[1]
+			case "webhook_debounce":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("webhook_debounce parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("webhook_debounce must be >= 0, got %s", v)
+				}
+				cfg.Webhook.Debounce = v
+			case "admin":
+				if len(args) != 2 {
+					return cfg, fmt.Errorf("admin requires listen address and token file")
+				}
+				if err := validateLoopbackAddr(args[0]); err != nil {
+					return cfg, fmt.Errorf("admin parse: %w", err)
+				}
+				cfg.Admin = AdminConfig{Addr: args[0], TokenFile: args[1]}
+			case "stale_threshold":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("stale_threshold parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("stale_threshold must be >= 0, got %s", v)
+				}
+				cfg.StaleThreshold = v
+			case "wait_for_sync":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("wait_for_sync parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("wait_for_sync must be >= 0, got %s", v)
+				}
+				cfg.WaitForSync = v
+				cfg.WaitForSyncWarn = false
+				if len(args) > 1 {
+					switch args[1] {
+					case "fail":
+					case "warn":
+						cfg.WaitForSyncWarn = true
+					default:
+						return cfg, fmt.Errorf("wait_for_sync mode must be fail or warn, got %s", args[1])
+					}
+				}
 			case "allowed_networks":
 				cfg.AllowedCIDRs = append(cfg.AllowedCIDRs, args...)
 			case "ttl":
@@ -89,6 +301,9 @@ func parse(c *caddy.Controller) (Config, error) {
 				if err != nil {
 					return cfg, fmt.Errorf("refresh parse: %w", err)
 				}
+				if v <= 0 {
+					return cfg, fmt.Errorf("refresh must be > 0, got %s", v)
+				}
 				cfg.Refresh = v
 			case "timeout":
 				v, err := time.ParseDuration(args[0])
@@ -105,6 +320,48 @@ func parse(c *caddy.Controller) (Config, error) {
 					return cfg, fmt.Errorf("max_retries must be >= 0, got %d", v)
 				}
 				cfg.MaxRetries = v
+			case "circuit_breaker":
+				if len(args) > 2 {
+					return cfg, fmt.Errorf("circuit_breaker requires failures and optional cooldown")
+				}
+				v, err := strconv.Atoi(args[0])
+				if err != nil || v < 0 {
+					return cfg, fmt.Errorf("circuit_breaker failures must be >= 0, got %s", args[0])
+				}
+				cfg.Breaker.Threshold = v
+				if len(args) == 2 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return cfg, fmt.Errorf("circuit_breaker cooldown parse: %w", err)
+					}
+					if d <= 0 {
+						return cfg, fmt.Errorf("circuit_breaker cooldown must be > 0, got %s", d)
+					}
+					cfg.Breaker.Cooldown = d
+				}
+			case "max_backoff":
+				v, err := time.ParseDuration(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("max_backoff parse: %w", err)
+				}
+				if v < 0 {
+					return cfg, fmt.Errorf("max_backoff must be >= 0, got %s", v)
+				}
+				cfg.MaxBackoff = v
+			case "tls_ca":
+				cfg.TLS.CA = args[0]
+			case "tls_cert":
+				cfg.TLS.Cert = args[0]
+			case "tls_key":
+				cfg.TLS.Key = args[0]
+			case "tls_server_name":
+				cfg.TLS.ServerName = args[0]
+			case "tls_insecure":
+				v, err := strconv.ParseBool(args[0])
+				if err != nil {
+					return cfg, fmt.Errorf("tls_insecure parse: %w", err)
+				}
+				cfg.TLS.Insecure = v
 			case "strict_start":
 				v, err := strconv.ParseBool(args[0])
 				if err != nil {
@@ -119,6 +376,12 @@ func parse(c *caddy.Controller) (Config, error) {
 					return cfg, fmt.Errorf("allow_short_names parse: %w", err)
 				}
 				cfg.AllowShort = v
+			case "view":
+				v, err := parseViewRule(args)
+				if err != nil {
+					return cfg, fmt.Errorf("view parse: %w", err)
+				}
+				cfg.Views = append(cfg.Views, v)
 			default:
 				return cfg, fmt.Errorf("unknown option %s", k)
 			}
@@ -128,12 +391,25 @@ func parse(c *caddy.Controller) (Config, error) {
 	if cfg.APIURL == "" || cfg.NetworkID == "" || cfg.Zone == "." {
 		return cfg, fmt.Errorf("api_url, network_id and zone are required")
 	}
+	for _, base := range append([]string{cfg.APIURL}, cfg.APIFallbackURLs...) {
+		if socket, ok := unixSocketPath(base); ok && !strings.HasPrefix(socket, "/") {
+			return cfg, fmt.Errorf("api_url %s must be unix:///absolute/path.sock", base)
+		}
+	}
 	if err := validateNetworkID(cfg.NetworkID); err != nil {
 		return cfg, fmt.Errorf("network_id parse: %w", err)
 	}
 	if tokenSources != 1 {
 		return cfg, fmt.Errorf("exactly one token source required")
 	}
+	// the secondary command shares token_command_ttl and token_command_timeout.
+	cfg.SecondaryToken.CommandTTL, cfg.SecondaryToken.CommandTimeout = cfg.Token.CommandTTL, cfg.Token.CommandTimeout
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return cfg, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if cfg.DynamicUpdates && len(cfg.TSIGKeys) == 0 {
+		return cfg, fmt.Errorf("dynamic_updates requires at least one tsig_key")
+	}
 	if cfg.SearchDomain == "" {
 		cfg.SearchDomain = cfg.Zone
 	}
@@ -0,0 +1,150 @@
+package ztnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrResponseTooLarge reports an API response body above the configured max_response_size.
+var ErrResponseTooLarge = errors.New("response too large")
+
+const (
+	defaultMaxResponseBytes = 10 << 20
+	// maxMemberPages stops following next links that never end.
+	maxMemberPages = 1000
+)
+
+// responseDecoder is implemented by results that decode the response body themselves.
+type responseDecoder interface {
+	decodeResponse(resp *http.Response, body io.Reader) error
+}
+
+// limitedBody reads at most n bytes and fails with ErrResponseTooLarge when the body is longer.
+type limitedBody struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var probe [1]byte
+		if n, _ := l.r.Read(probe[:]); n > 0 {
+			return 0, fmt.Errorf("%w: limit %d bytes", ErrResponseTooLarge, l.limit)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (c *APIClient) maxResponseBytes() int64 {
+	if c.MaxResponseBytes > 0 {
+		return c.MaxResponseBytes
+	}
+	return defaultMaxResponseBytes
+}
+
+// validatedResult is implemented by results that restrict conditional requests.
+type validatedResult interface {
+	// conditional reports whether the request may carry stored validators.
+	conditional() bool
+	// cacheable reports whether the validators of the decoded response may be stored.
+	cacheable() bool
+}
+
+// memberPage stream-decodes one page of the member array, keeping authorized members only.
+// Only an unpaginated member list is revalidated: an unchanged first page says nothing
+// about the pages after it.
+type memberPage struct {
+	first   bool
+	path    string
+	members []Member
+	next    string
+}
+
+func (m *memberPage) conditional() bool { return m.first }
+
+func (m *memberPage) cacheable() bool { return m.first && m.next == "" }
+
+func (m *memberPage) decodeResponse(resp *http.Response, body io.Reader) error {
+	m.next = nextLink(resp, m.path)
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected member array, got %v", tok)
+	}
+	for dec.More() {
+		var member Member
+		if err := dec.Decode(&member); err != nil {
+			return err
+		}
+		if member.Authorized {
+			m.members = append(m.members, member)
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// nextLink returns the API path of an RFC 8288 rel="next" link, relative to the
+// endpoint like path, the request that resp answers. The host and the api_url path
+// prefix are dropped so pagination stays on the endpoint that served the first page.
+func nextLink(resp *http.Response, path string) string {
+	for _, header := range resp.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(k, "rel") || !strings.Contains(" "+strings.Trim(v, `"`)+" ", " next ") {
+					continue
+				}
+				u, err := resp.Request.URL.Parse(strings.Trim(target, "<>"))
+				if err != nil {
+					return ""
+				}
+				requested, _, _ := strings.Cut(path, "?")
+				prefix := strings.TrimSuffix(resp.Request.URL.EscapedPath(), requested)
+				if prefix == resp.Request.URL.EscapedPath() {
+					prefix = ""
+				}
+				return strings.TrimPrefix(u.RequestURI(), prefix)
+			}
+		}
+	}
+	return ""
+}
+
+// parseByteSize parses a size in bytes with an optional K, M or G (binary) suffix.
+func parseByteSize(v string) (int64, error) {
+	digits, mult := v, int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		digits, mult = v[:len(v)-1], 1<<10
+	case strings.HasSuffix(v, "M"):
+		digits, mult = v[:len(v)-1], 1<<20
+	case strings.HasSuffix(v, "G"):
+		digits, mult = v[:len(v)-1], 1<<30
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * mult, nil
+}
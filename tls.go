@@ -0,0 +1,214 @@
+package ztnet
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// TLSConfig configures TLS for the ZTNET API client. CA and client certificate
+// files are re-read when they change, so rotation does not need a reload.
+type TLSConfig struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+	Insecure   bool
+}
+
+// tlsFiles caches the CA pool and client certificate keyed by file modification time.
+type tlsFiles struct {
+	cfg TLSConfig
+
+	mu        sync.Mutex
+	pool      *x509.CertPool
+	poolMod   time.Time
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastError string
+}
+
+// configureTLS applies cfg to the API transport; it is a no-op when no TLS option is set.
+func configureTLS(tr *http.Transport, cfg TLSConfig) error {
+	if cfg == (TLSConfig{}) {
+		return nil
+	}
+	f := &tlsFiles{cfg: cfg}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName, InsecureSkipVerify: cfg.Insecure}
+	if cfg.Insecure {
+		clog.Warningf("ztnet: tls_insecure is set, the ZTNET API certificate is not verified")
+	}
+	if cfg.Cert != "" {
+		if _, err := f.clientCert(); err != nil {
+			return err
+		}
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return f.clientCert()
+		}
+	}
+	if cfg.CA != "" && !cfg.Insecure {
+		pool, err := f.caPool()
+		if err != nil {
+			return err
+		}
+		tc.RootCAs = pool
+	}
+	// direct connections verify against the current CA file instead of the startup pool.
+	// The transport dials an https proxy through DialTLSContext as well; that connection
+	// is verified like any other host, without the API's TLS options.
+	proxies := trackHTTPSProxies(tr)
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := proxies.Load(addr); ok {
+			return handshake(ctx, dial, &tls.Config{MinVersion: tls.VersionTLS12}, network, addr)
+		}
+		return f.dialTLS(ctx, dial, tc, network, addr)
+	}
+	tr.TLSClientConfig = tc
+	return nil
+}
+
+// trackHTTPSProxies wraps tr.Proxy to record the address of every https proxy it
+// returns, in the host:port form the transport dials.
+func trackHTTPSProxies(tr *http.Transport) *sync.Map {
+	proxies := &sync.Map{}
+	proxy := tr.Proxy
+	if proxy == nil {
+		return proxies
+	}
+	tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u != nil && u.Scheme == "https" {
+			port := u.Port()
+			if port == "" {
+				port = "443"
+			}
+			proxies.Store(net.JoinHostPort(u.Hostname(), port), struct{}{})
+		}
+		return u, err
+	}
+	return proxies
+}
+
+func (f *tlsFiles) dialTLS(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), base *tls.Config, network, addr string) (net.Conn, error) {
+	tc := base.Clone()
+	if f.cfg.CA != "" && !f.cfg.Insecure {
+		pool, err := f.caPool()
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	return handshake(ctx, dial, tc, network, addr)
+}
+
+// handshake dials addr and completes a TLS handshake, naming the dialled host when
+// tc sets no ServerName.
+func handshake(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), tc *tls.Config, network, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tc.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tc)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (f *tlsFiles) caPool() (*x509.CertPool, error) {
+	st, err := os.Stat(f.cfg.CA)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		return f.stalePool(err)
+	}
+	if f.pool != nil && st.ModTime().Equal(f.poolMod) {
+		return f.pool, nil
+	}
+	pem, err := os.ReadFile(f.cfg.CA)
+	if err != nil {
+		return f.stalePool(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return f.stalePool(fmt.Errorf("no certificates found in %s", f.cfg.CA))
+	}
+	if f.pool != nil {
+		clog.Infof("ztnet: reloaded tls_ca %s", f.cfg.CA)
+	}
+	f.pool, f.poolMod, f.lastError = pool, st.ModTime(), ""
+	return pool, nil
+}
+
+func (f *tlsFiles) clientCert() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	certSt, err := os.Stat(f.cfg.Cert)
+	if err != nil {
+		return f.staleCert(err)
+	}
+	keySt, err := os.Stat(f.cfg.Key)
+	if err != nil {
+		return f.staleCert(err)
+	}
+	if f.cert != nil && certSt.ModTime().Equal(f.certMod) && keySt.ModTime().Equal(f.keyMod) {
+		return f.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(f.cfg.Cert, f.cfg.Key)
+	if err != nil {
+		return f.staleCert(err)
+	}
+	if f.cert != nil {
+		clog.Infof("ztnet: reloaded tls_cert %s", f.cfg.Cert)
+	}
+	f.cert, f.certMod, f.keyMod, f.lastError = &cert, certSt.ModTime(), keySt.ModTime(), ""
+	return f.cert, nil
+}
+
+// stalePool keeps serving the last good CA pool when the file is unreadable; f.mu is held.
+func (f *tlsFiles) stalePool(err error) (*x509.CertPool, error) {
+	if f.pool == nil {
+		return nil, fmt.Errorf("tls_ca: %w", err)
+	}
+	f.logOnce(fmt.Sprintf("ztnet: keeping previous tls_ca: %v", err))
+	return f.pool, nil
+}
+
+// staleCert keeps presenting the last good client certificate; f.mu is held.
+func (f *tlsFiles) staleCert(err error) (*tls.Certificate, error) {
+	if f.cert == nil {
+		return nil, fmt.Errorf("tls_cert: %w", err)
+	}
+	f.logOnce(fmt.Sprintf("ztnet: keeping previous client certificate: %v", err))
+	return f.cert, nil
+}
+
+// logOnce warns about a reload problem until it changes; f.mu is held.
+func (f *tlsFiles) logOnce(msg string) {
+	if msg != f.lastError {
+		clog.Warning(msg)
+		f.lastError = msg
+	}
+}
@@ -0,0 +1,91 @@
+package ztnet
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// newTokenWatcher watches the directory holding token_file, so atomic
+// replacements (rename over the file, symlink swaps) are seen as well as writes.
+func (p *ZtnetPlugin) newTokenWatcher() *fsnotify.Watcher {
+	if p.cfg.Token.Source != TokenSourceFile {
+		return nil
+	}
+	p.recordTokenFileTime()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		clog.Warningf("ztnet: cannot watch token_file, rotation is picked up on the next refresh: %v", err)
+		return nil
+	}
+	if err := w.Add(filepath.Dir(p.cfg.Token.Value)); err != nil {
+		clog.Warningf("ztnet: cannot watch token_file, rotation is picked up on the next refresh: %v", err)
+		_ = w.Close()
+		return nil
+	}
+	return w
+}
+
+// watchToken validates a rotated token and refreshes immediately when ZTNET accepts it.
+// last is the token read when the watch was set up.
+func (p *ZtnetPlugin) watchToken(ctx context.Context, w *fsnotify.Watcher, last string) {
+	defer w.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			clog.Warningf("ztnet: token_file watch error: %v", err)
+		case _, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// every event in the directory re-reads the file; unchanged content is ignored.
+			token, err := LoadToken(p.cfg.Token)
+			if err != nil {
+				tokenReload.WithLabelValues(p.zone, TokenSourceFile, "error").Inc()
+				clog.Warningf("ztnet: token_file changed but cannot be used, keeping the current token: %v", err)
+				continue
+			}
+			if token == last {
+				continue
+			}
+			last = token
+			p.recordTokenFileTime()
+			if err := p.validateToken(ctx, token); err != nil {
+				if errors.Is(err, ErrUnauthorized) {
+					tokenReload.WithLabelValues(p.zone, TokenSourceFile, "rejected").Inc()
+					clog.Errorf("ztnet: rotated token in %s was rejected by the API", p.cfg.Token.Value)
+					continue
+				}
+				clog.Warningf("ztnet: cannot validate rotated token, refreshing anyway: %v", err)
+			}
+			clog.Infof("ztnet: token_file rotated, refreshing zone %s", p.zone)
+			if err := p.refresh(ctx); err != nil {
+				clog.Warningf("ztnet: refresh after token rotation failed: %v", err)
+			}
+		}
+	}
+}
+
+func (p *ZtnetPlugin) validateToken(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	return p.api.ValidateToken(ctx, token)
+}
+
+// recordTokenFileTime exports the token file modification time.
+func (p *ZtnetPlugin) recordTokenFileTime() {
+	st, err := os.Stat(p.cfg.Token.Value)
+	if err != nil {
+		return
+	}
+	tokenMtime.WithLabelValues(p.zone).Set(float64(st.ModTime().Unix()))
+}
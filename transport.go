@@ -0,0 +1,111 @@
+package ztnet
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	unixScheme = "unix://"
+	// APIProxyNone disables proxying, including HTTPS_PROXY/HTTP_PROXY from the environment.
+	APIProxyNone = "none"
+)
+
+// unixSocketPath returns the socket path of a unix:///path.sock api_url.
+func unixSocketPath(base string) (string, bool) {
+	if !strings.HasPrefix(base, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(base, unixScheme), true
+}
+
+// unixHost is the synthetic HTTP host for a socket; one per path keeps connection pools apart.
+func unixHost(socket string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(socket))
+	return fmt.Sprintf("unix-%08x.invalid", h.Sum32())
+}
+
+// requestBase maps an api_url to the base URL put on requests.
+func requestBase(base string) string {
+	if socket, ok := unixSocketPath(base); ok {
+		return "http://" + unixHost(socket)
+	}
+	return strings.TrimRight(base, "/")
+}
+
+// parseAPIProxy validates an api_proxy value: none or an http, https or socks5 URL.
+func parseAPIProxy(v string) error {
+	if v == APIProxyNone {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing proxy host in %s", v)
+	}
+	return nil
+}
+
+// newAPITransport builds the HTTP transport for the ZTNET API: unix socket endpoints,
+// api_proxy (environment proxies by default) and TLS options.
+func newAPITransport(cfg Config) (*http.Transport, error) {
+	dialer := &net.Dialer{Timeout: cfg.Timeout / 2}
+	sockets := make(map[string]string)
+	for _, base := range append([]string{cfg.APIURL}, cfg.APIFallbackURLs...) {
+		if socket, ok := unixSocketPath(base); ok {
+			sockets[unixHost(socket)] = socket
+		}
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil {
+				if socket, ok := sockets[host]; ok {
+					return dialer.DialContext(ctx, "unix", socket)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   cfg.Timeout / 2,
+		ResponseHeaderTimeout: cfg.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	proxy := http.ProxyFromEnvironment
+	switch cfg.APIProxy {
+	case "":
+	case APIProxyNone:
+		proxy = nil
+	default:
+		u, err := url.Parse(cfg.APIProxy)
+		if err != nil {
+			return nil, fmt.Errorf("api_proxy: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	if proxy != nil {
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, ok := sockets[req.URL.Hostname()]; ok {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+	if err := configureTLS(tr, cfg.TLS); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
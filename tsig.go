@@ -0,0 +1,81 @@
+package ztnet
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const tsigFudge = 300
+
+// parseTSIGKey parses `tsig_key <name> <base64-secret>` arguments.
+func parseTSIGKey(args []string) (string, string, error) {
+	if len(args) != 2 {
+		return "", "", fmt.Errorf("tsig_key requires a key name and a base64 secret")
+	}
+	name := dns.CanonicalName(args[0])
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", "", fmt.Errorf("invalid key name %q", args[0])
+	}
+	if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+		return "", "", fmt.Errorf("key %s secret: %w", name, err)
+	}
+	return name, args[1], nil
+}
+
+// tsigAuth checks r for a TSIG signed by a configured key. It reports the key name and
+// whether the signature verified; key is empty when r carries no TSIG for a ztnet key.
+// The MAC is checked here as well as by the server: DoH, DoQ and gRPC writers report
+// every TSIG as valid without verifying it.
+func (p *ZtnetPlugin) tsigAuth(w dns.ResponseWriter, r *dns.Msg) (key string, ok bool) {
+	t := r.IsTsig()
+	if t == nil {
+		return "", false
+	}
+	key = strings.ToLower(t.Hdr.Name)
+	secret, configured := p.cfg.TSIGKeys[key]
+	if !configured {
+		return "", false
+	}
+	if err := w.TsigStatus(); err != nil || verifyTSIG(r, secret) != nil {
+		tsigCount.WithLabelValues(p.zone, key, "bad").Inc()
+		return key, false
+	}
+	tsigCount.WithLabelValues(p.zone, key, "ok").Inc()
+	return key, true
+}
+
+// verifyTSIG checks the MAC of r against secret on its wire form. The original bytes
+// are gone, so r is packed both without and with name compression.
+func verifyTSIG(r *dns.Msg, secret string) error {
+	var err error
+	for _, compress := range []bool{false, true} {
+		m := r.Copy()
+		m.Compress = compress
+		buf, packErr := m.Pack()
+		if packErr != nil {
+			return packErr
+		}
+		if err = dns.TsigVerify(buf, secret, "", false); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// tsigWriter signs every response with the key that authenticated the request.
+type tsigWriter struct {
+	dns.ResponseWriter
+	key       string
+	algorithm string
+}
+
+func (t *tsigWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		m.SetTsig(t.key, t.algorithm, tsigFudge, time.Now().Unix())
+	}
+	return t.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,93 @@
+package ztnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// serveUpdate handles an RFC 2136 UPDATE by renaming the member that owns src.
+// Only A/AAAA additions of a single label directly under the zone are honoured;
+// deletions are accepted as no-ops since the old name disappears with the rename.
+// Unsigned updates reach it only from allowed sources within the rate limit.
+func (p *ZtnetPlugin) serveUpdate(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, src net.IP, subnet *net.IPNet, signed bool) (int, error) {
+	rcode := p.applyUpdate(ctx, r, src, subnet, signed)
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	_ = w.WriteMsg(m)
+	updateCount.WithLabelValues(p.zone, dns.RcodeToString[rcode]).Inc()
+	requestCount.WithLabelValues(p.zone, dns.RcodeToString[rcode]).Inc()
+	return rcode, nil
+}
+
+func (p *ZtnetPlugin) applyUpdate(ctx context.Context, r *dns.Msg, src net.IP, subnet *net.IPNet, signed bool) int {
+	if !p.cfg.DynamicUpdates || !signed {
+		clog.Warningf("ztnet: REFUSED update src=%v signed=%v", src, signed)
+		return dns.RcodeRefused
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if strings.ToLower(r.Question[0].Name) != p.zone {
+		return dns.RcodeNotZone
+	}
+	if len(r.Answer) > 0 {
+		// prerequisites are not evaluated against ZTNET state.
+		return dns.RcodeNotImplemented
+	}
+
+	label := ""
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		if h.Class != dns.ClassINET {
+			continue
+		}
+		if h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA {
+			return dns.RcodeRefused
+		}
+		name := strings.ToLower(h.Name)
+		if !dns.IsSubDomain(p.zone, name) || name == p.zone {
+			return dns.RcodeNotZone
+		}
+		l := strings.TrimSuffix(name, "."+p.zone)
+		if strings.Contains(l, ".") || isReservedLabel(l) || (label != "" && l != label) {
+			return dns.RcodeRefused
+		}
+		label = l
+	}
+	if label == "" {
+		return dns.RcodeSuccess
+	}
+
+	// a client prefix does not identify the member to rename.
+	member, ok := p.cache.LookupMember(src)
+	if !ok || subnet != nil {
+		clog.Warningf("ztnet: REFUSED update for %s from non-member src=%v", label, src)
+		return dns.RcodeRefused
+	}
+	if owner, taken := p.cache.LookupOwner(dns.Fqdn(label + "." + p.zone)); taken && owner.NodeID != member.NodeID {
+		clog.Warningf("ztnet: REFUSED update for %s from %s: name owned by %s", label, member.NodeID, owner.NodeID)
+		return dns.RcodeYXDomain
+	}
+
+	token, err := p.apiToken()
+	if err != nil {
+		clog.Errorf("ztnet: update load token: %v", err)
+		return dns.RcodeServerFailure
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	if err := p.api.UpdateMemberName(ctx, token, member.NodeID, label); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			clog.Errorf("ztnet: unauthorized against API member update endpoint")
+		}
+		clog.Errorf("ztnet: update member %s name %s: %v", member.NodeID, label, err)
+		return dns.RcodeServerFailure
+	}
+	clog.Infof("ztnet: renamed member %s to %s via dynamic update", member.NodeID, label)
+	return dns.RcodeSuccess
+}
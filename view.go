@@ -0,0 +1,118 @@
+package ztnet
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+const viewTagPrefix = "tag:"
+
+// ViewRule restricts which members a matching querier may resolve.
+// A querier matches when its source IP is inside SourceNet or its member carries SourceTag.
+type ViewRule struct {
+	SourceNet *net.IPNet
+	SourceTag string
+	Names     []string
+	Tags      []string
+}
+
+// parseViewRule parses `view <cidr|tag:name> <name|tag:name>...` arguments.
+func parseViewRule(args []string) (ViewRule, error) {
+	if len(args) < 2 {
+		return ViewRule{}, fmt.Errorf("view requires a source and at least one target")
+	}
+	var v ViewRule
+	src := strings.ToLower(strings.TrimSpace(args[0]))
+	if tag, ok := strings.CutPrefix(src, viewTagPrefix); ok {
+		if tag == "" {
+			return ViewRule{}, fmt.Errorf("view source tag is empty")
+		}
+		v.SourceTag = tag
+	} else {
+		_, n, err := net.ParseCIDR(src)
+		if err != nil {
+			return ViewRule{}, fmt.Errorf("view source %q: %w", args[0], err)
+		}
+		v.SourceNet = n
+	}
+	for _, raw := range args[1:] {
+		target := normalizeMemberName(raw)
+		if tag, ok := strings.CutPrefix(target, viewTagPrefix); ok {
+			if tag == "" {
+				return ViewRule{}, fmt.Errorf("view target tag is empty")
+			}
+			v.Tags = append(v.Tags, tag)
+			continue
+		}
+		v.Names = append(v.Names, target)
+	}
+	return v, nil
+}
+
+func normalizeMemberName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+}
+
+// matchesSource reports whether the querier matches v. A client prefix (subnet) matches
+// a CIDR source it overlaps, so the narrower view applies, and never matches a tag.
+func (v ViewRule) matchesSource(src net.IP, subnet *net.IPNet, querier MemberIdentity, isMember bool) bool {
+	if v.SourceNet != nil {
+		if subnet != nil {
+			return v.SourceNet.Contains(subnet.IP) || subnet.Contains(v.SourceNet.IP)
+		}
+		if src == nil {
+			return false
+		}
+		if v4 := src.To4(); v4 != nil {
+			src = v4
+		}
+		return v.SourceNet.Contains(src)
+	}
+	return isMember && slices.Contains(querier.Tags, v.SourceTag)
+}
+
+func (v ViewRule) allows(owner MemberIdentity) bool {
+	if slices.Contains(v.Names, owner.NodeID) || (owner.Name != "" && slices.Contains(v.Names, normalizeMemberName(owner.Name))) {
+		return true
+	}
+	for _, tag := range owner.Tags {
+		if slices.Contains(v.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether the querier at src may resolve the member record name.
+// subnet is set when the querier is only known by a client prefix and so is not a member.
+// Queriers matching no view see every member; matching queriers see the union of their views.
+func (p *ZtnetPlugin) visible(src net.IP, subnet *net.IPNet, name string) bool {
+	if len(p.cfg.Views) == 0 {
+		return true
+	}
+	owner, ok := p.cache.LookupOwner(name)
+	if !ok {
+		return true
+	}
+	var querier MemberIdentity
+	isMember := false
+	if subnet == nil {
+		querier, isMember = p.cache.LookupMember(src)
+	}
+	if isMember && querier.NodeID == owner.NodeID {
+		return true
+	}
+	matched := false
+	for _, v := range p.cfg.Views {
+		if !v.matchesSource(src, subnet, querier, isMember) {
+			continue
+		}
+		matched = true
+		if v.allows(owner) {
+			return true
+		}
+	}
+	return !matched
+}
@@ -0,0 +1,80 @@
+package ztnet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "X-Ztnet-Signature"
+	maxWebhookBody         = 1 << 20
+)
+
+// WebhookConfig defines the optional listener that turns ZTNET webhooks into refreshes.
+type WebhookConfig struct {
+	Addr       string
+	SecretFile string
+	Debounce   time.Duration
+}
+
+// readSecretFile reads a trimmed, non-empty secret; it is re-read on every use to allow rotation.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("secret read: %w", err)
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return "", fmt.Errorf("secret file %s empty", path)
+	}
+	return s, nil
+}
+
+// validWebhookSignature checks a `sha256=<hex>` HMAC-SHA256 of body keyed with secret.
+func validWebhookSignature(secret string, body []byte, header string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(header), "sha256="))
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// webhookHandler validates signed ZTNET webhook calls and schedules a debounced refresh.
+func (p *ZtnetPlugin) webhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			webhookCount.WithLabelValues(p.zone, "error").Inc()
+			http.Error(w, "read body", http.StatusBadRequest)
+			return
+		}
+		secret, err := readSecretFile(p.cfg.Webhook.SecretFile)
+		if err != nil {
+			webhookCount.WithLabelValues(p.zone, "error").Inc()
+			http.Error(w, "webhook secret unavailable", http.StatusInternalServerError)
+			return
+		}
+		if !validWebhookSignature(secret, body, r.Header.Get(webhookSignatureHeader)) {
+			webhookCount.WithLabelValues(p.zone, "unauthorized").Inc()
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		webhookCount.WithLabelValues(p.zone, "ok").Inc()
+		p.requestRefresh()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,46 @@
+package ztnet
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Reserved labels answered from the querier's own identity instead of member records.
+const (
+	whoamiLabel = "whoami"
+	selfLabel   = "self"
+)
+
+func isReservedLabel(label string) bool {
+	return label == whoamiLabel || label == selfLabel
+}
+
+// whoamiTXT describes the querier's source IP and, when known, its ZeroTier member identity.
+// A querier known only by a client prefix (subnet) is reported as that prefix without identity.
+func (p *ZtnetPlugin) whoamiTXT(name string, src net.IP, subnet *net.IPNet) *dns.TXT {
+	ip := "unknown"
+	switch {
+	case subnet != nil:
+		ip = subnet.String()
+	case src != nil:
+		ip = memberIPKey(src)
+	}
+	txt := []string{"ip=" + ip}
+	if id, ok := p.cache.LookupMember(src); ok && subnet == nil {
+		txt = append(txt, "node="+id.NodeID)
+		if id.Name != "" {
+			txt = append(txt, "name="+id.Name)
+		}
+	}
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: txt}
+}
+
+// selfRecords returns the A/AAAA addresses of the member owning src.
+func (p *ZtnetPlugin) selfRecords(src net.IP) ([]net.IP, []net.IP) {
+	id, ok := p.cache.LookupMember(src)
+	if !ok {
+		return nil, nil
+	}
+	return p.cache.LookupBoth(dns.Fqdn(id.NodeID + "." + p.zone))
+}
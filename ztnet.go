@@ -7,6 +7,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -28,15 +29,100 @@ type Config struct {
 	StrictStart  bool
 	SearchDomain string
 	AllowShort   bool
+	Views        []ViewRule
+	ACLMode      string
+	Deny         DenyConfig
+	RateLimit    RateLimitConfig
+	// TrustedForwarders are peers whose EDNS Client Subnet option is used as the query source.
+	TrustedForwarders []*net.IPNet
+	// TrustedProxies are peers whose propagated client address (ClientIPMetadata label or
+	// DoH X-Forwarded-For) is used as the query source.
+	TrustedProxies   []*net.IPNet
+	ClientIPMetadata string
+	// TSIGKeys maps key names to base64 secrets; valid signatures bypass the source allowlist.
+	TSIGKeys map[string]string
+	// DynamicUpdates enables TSIG-signed RFC 2136 updates that rename the sending member.
+	DynamicUpdates bool
+	Webhook        WebhookConfig
+	Admin          AdminConfig
+	// StaleThreshold marks the zone degraded when no refresh succeeded for this long; 0 disables.
+	StaleThreshold time.Duration
+	// WaitForSync blocks startup until the first successful refresh; WaitForSyncWarn only warns on timeout.
+	WaitForSync     time.Duration
+	WaitForSyncWarn bool
+	// Breaker configures the API circuit breaker.
+	Breaker BreakerConfig
+	// MaxBackoff caps the refresh interval while refreshes keep failing.
+	MaxBackoff time.Duration
+	// APIFallbackURLs are extra api_url values used when APIURL is unavailable;
+	// APIProbeInterval is how often the other endpoints are health checked.
+	APIFallbackURLs  []string
+	APIProbeInterval time.Duration
+	// APIProxy is the proxy URL for API requests, APIProxyNone for direct
+	// connections, or empty to use HTTPS_PROXY/HTTP_PROXY/NO_PROXY.
+	APIProxy string
+	// MaxResponseSize limits each API response body in bytes.
+	MaxResponseSize int64
+	// SecondaryToken, when set, is tried when the API rejects Token.
+	SecondaryToken TokenConfig
+	// TLS configures the API client's CA, client certificate and server name checks.
+	TLS TLSConfig
 }
 
 type ZtnetPlugin struct {
-	Next   plugin.Handler
-	zone   string
-	cfg    Config
-	cache  *RecordCache
-	api    *APIClient
-	cancel context.CancelFunc
+	Next     plugin.Handler
+	zone     string
+	cfg      Config
+	cache    *RecordCache
+	api      *APIClient
+	limiter  *rateLimiter
+	trigger  chan struct{}
+	status   refreshStatus
+	degraded atomic.Bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// source is the instance owning the shared refresh loop when it is not p itself.
+	source *ZtnetPlugin
+	joined bool
+
+	// useSecondary records that the last refresh authenticated with the secondary token.
+	useSecondary atomic.Bool
+
+	// refreshMu serializes refreshes and guards the last fetched API data,
+	// reused when a conditional request reports it unchanged.
+	refreshMu   sync.Mutex
+	lastMembers []Member
+	lastNetwork NetworkInfo
+	// lastBuilt records that the cache was built from lastMembers and lastNetwork.
+	lastBuilt bool
+}
+
+type refreshState struct {
+	lastOK  time.Time
+	lastErr string
+}
+
+// refreshStatus records the outcome of the most recent refresh attempts.
+type refreshStatus struct {
+	mu    sync.Mutex
+	state refreshState
+}
+
+func (s *refreshStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.state.lastErr = err.Error()
+		return
+	}
+	s.state.lastOK = time.Now()
+	s.state.lastErr = ""
+}
+
+func (s *refreshStatus) get() refreshState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
 }
 
 func (p *ZtnetPlugin) Name() string { return "ztnet" }
@@ -68,16 +154,52 @@ func (p *ZtnetPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 	if !inZone {
 		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
 	}
-	src := extractSourceIP(w)
-	if !p.cache.IsAllowed(src, p.cfg.StrictStart) {
-		clog.Warningf("ztnet: REFUSED query name=%s type=%d src=%v", qname, q.Qtype, src)
+	src := clientSourceIP(ctx, w, p.cfg.TrustedProxies, p.cfg.ClientIPMetadata)
+	// subnet is the querier's ECS prefix when it is shorter than a host address; such a
+	// querier is never matched to a member.
+	var subnet *net.IPNet
+	ecs := clientSubnet(src, r, p.cfg.TrustedForwarders)
+	if n := ecsNet(ecs); n != nil {
+		src = n.IP
+		if ones, bits := n.Mask.Size(); ones < bits {
+			subnet = n
+		}
+	}
+	key, signed := p.tsigAuth(w, r)
+	if key != "" && !signed {
+		clog.Warningf("ztnet: TSIG verification failed key=%s name=%s src=%v", key, qname, src)
 		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Rcode = dns.RcodeRefused
+		m.SetRcode(r, dns.RcodeNotAuth)
 		_ = w.WriteMsg(m)
-		refusedCount.WithLabelValues(p.zone).Inc()
-		requestCount.WithLabelValues(p.zone, dns.RcodeToString[dns.RcodeRefused]).Inc()
-		return dns.RcodeRefused, nil
+		requestCount.WithLabelValues(p.zone, dns.RcodeToString[dns.RcodeNotAuth]).Inc()
+		return dns.RcodeNotAuth, nil
+	}
+	if signed {
+		w = &tsigWriter{ResponseWriter: w, key: key, algorithm: r.IsTsig().Algorithm}
+	}
+	if ecs != nil {
+		// wraps the TSIG writer so the OPT record is added before the response is signed.
+		w = &ecsWriter{ResponseWriter: w, ecs: ecs, req: r.IsEdns0()}
+	}
+	if !signed && !p.sourceAllowed(src, subnet) {
+		return p.deny(w, r, qname, q.Qtype, src), nil
+	}
+	if p.limiter != nil {
+		if ok, slip := p.limiter.allow(src); !ok {
+			if !slip {
+				limitedCount.WithLabelValues(p.zone, "drop").Inc()
+				return dns.RcodeSuccess, nil
+			}
+			limitedCount.WithLabelValues(p.zone, "slip").Inc()
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			_ = w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		}
+	}
+	if r.Opcode == dns.OpcodeUpdate {
+		return p.serveUpdate(ctx, w, r, src, subnet, signed)
 	}
 
 	m := new(dns.Msg)
@@ -92,8 +214,29 @@ func (p *ZtnetPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 		return dns.RcodeSuccess, nil
 	}
 
+	if lookupName == whoamiLabel+"."+p.zone {
+		if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, p.whoamiTXT(lookupName, src, subnet))
+		}
+		_ = w.WriteMsg(m)
+		requestCount.WithLabelValues(p.zone, dns.RcodeToString[dns.RcodeSuccess]).Inc()
+		return dns.RcodeSuccess, nil
+	}
+
 	aRecords, aaaaRecords := p.cache.LookupBoth(lookupName)
 	foundName := len(aRecords) > 0 || len(aaaaRecords) > 0
+	if lookupName == selfLabel+"."+p.zone {
+		// self always exists; non-members get NODATA rather than NXDOMAIN.
+		aRecords, aaaaRecords = nil, nil
+		if subnet == nil {
+			aRecords, aaaaRecords = p.selfRecords(src)
+		}
+		foundName = true
+	} else if foundName && !p.visible(src, subnet, lookupName) {
+		// hide names outside the querier's view without leaking their existence.
+		aRecords, aaaaRecords = nil, nil
+		foundName = false
+	}
 
 	switch q.Qtype {
 	case dns.TypeA:
@@ -141,6 +284,14 @@ func (p *ZtnetPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 	return dns.RcodeSuccess, nil
 }
 
+// sourceAllowed checks the querier against the allowlist; a client prefix must be covered by an allowed CIDR.
+func (p *ZtnetPlugin) sourceAllowed(src net.IP, subnet *net.IPNet) bool {
+	if subnet != nil {
+		return p.cache.IsAllowedNet(subnet, p.cfg.StrictStart)
+	}
+	return p.cache.IsAllowed(src, p.cfg.StrictStart)
+}
+
 func (p *ZtnetPlugin) soaRecord() dns.RR {
 	return &dns.SOA{Hdr: dns.RR_Header{Name: p.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: p.cfg.TTL},
 		Ns: "ns1." + p.zone, Mbox: "hostmaster." + p.zone, Serial: p.cache.Serial(), Refresh: 3600, Retry: 600, Expire: 86400, Minttl: p.cfg.TTL}
@@ -148,51 +299,101 @@ func (p *ZtnetPlugin) soaRecord() dns.RR {
 
 func (p *ZtnetPlugin) start(ctx context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
-	p.cancel = cancel
+	done := make(chan struct{})
+	p.cancel, p.done = cancel, done
+	var wg sync.WaitGroup
+	if w := p.newTokenWatcher(); w != nil {
+		last, _ := LoadToken(p.cfg.Token)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.watchToken(ctx, w, last)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 	go func() {
+		defer wg.Done()
 		defer func() {
 			if r := recover(); r != nil {
 				clog.Errorf("ztnet: panic in refresh goroutine: %v", r)
 			}
 		}()
-		if err := p.refresh(ctx); err != nil {
+		// failures backs the refresh interval off while the API keeps failing.
+		failures := 0
+		next := func(err error) time.Duration {
+			if err != nil {
+				failures++
+			} else {
+				failures = 0
+			}
+			return backoffDelay(p.cfg.Refresh, p.cfg.MaxBackoff, failures, randomJitter)
+		}
+		err := p.refresh(ctx)
+		if err != nil {
 			clog.Warningf("ztnet: initial refresh failed for zone %s: %v", p.zone, err)
 		}
-		t := time.NewTicker(p.cfg.Refresh)
+		t := time.NewTimer(next(err))
 		defer t.Stop()
+		var probe <-chan time.Time
+		if len(p.cfg.APIFallbackURLs) > 0 && p.cfg.APIProbeInterval > 0 {
+			pt := time.NewTicker(p.cfg.APIProbeInterval)
+			defer pt.Stop()
+			probe = pt.C
+		}
+		var debounce <-chan time.Time
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-p.trigger:
+				// coalesce bursts of out-of-band requests into one refresh.
+				if debounce == nil {
+					debounce = time.After(p.cfg.Webhook.Debounce)
+				}
+			case <-debounce:
+				debounce = nil
+				err := p.refresh(ctx)
+				if err != nil {
+					clog.Warningf("ztnet: triggered refresh failed: %v", err)
+				}
+				t.Reset(next(err))
+			case <-probe:
+				p.probeEndpoints(ctx)
 			case <-t.C:
-				if err := p.refresh(ctx); err != nil {
-					clog.Warningf("ztnet: refresh failed: %v", err)
+				err := p.refresh(ctx)
+				d := next(err)
+				if err != nil {
+					clog.Warningf("ztnet: refresh failed, next attempt in %s: %v", d.Round(time.Second), err)
 				}
+				t.Reset(d)
 			}
 		}
 	}()
 }
 
+// requestRefresh schedules an out-of-band refresh without blocking; the periodic ticker keeps running.
+func (p *ZtnetPlugin) requestRefresh() {
+	select {
+	case p.poller().trigger <- struct{}{}:
+	default:
+	}
+}
+
+// stop cancels the refresh loop and waits for it to exit.
 func (p *ZtnetPlugin) stop() {
 	if p.cancel != nil {
 		p.cancel()
+		<-p.done
+		p.cancel, p.done = nil, nil
 	}
 }
 
-func (p *ZtnetPlugin) refresh(ctx context.Context) error {
-	token, err := LoadToken(p.cfg.Token)
-	if err != nil {
-		tokenReload.WithLabelValues(p.zone, p.cfg.Token.Source, "error").Inc()
-		refreshCount.WithLabelValues(p.zone, "error").Inc()
-		return fmt.Errorf("load token: %w", err)
-	}
-	tokenReload.WithLabelValues(p.zone, p.cfg.Token.Source, "ok").Inc()
-	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
-	defer cancel()
-
-	var members []Member
-	var netinfo NetworkInfo
-	var membersErr, netErr error
+// fetch loads the member list and network details concurrently.
+func (p *ZtnetPlugin) fetch(ctx context.Context, token string) (members []Member, netinfo NetworkInfo, membersErr, netErr error) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -204,43 +405,153 @@ func (p *ZtnetPlugin) refresh(ctx context.Context) error {
 		netinfo, netErr = p.api.FetchNetwork(ctx, token)
 	}()
 	wg.Wait()
+	return members, netinfo, membersErr, netErr
+}
+
+// recordTokenAuth counts which token a refresh authenticated with and logs when that
+// changes. Errors that carry no API answer, such as outages, leave both untouched.
+func (p *ZtnetPlugin) recordTokenAuth(secondary bool, errs ...error) {
+	name := "primary"
+	if secondary {
+		name = "secondary"
+	}
+	if unauthorized(errs...) {
+		tokenAuth.WithLabelValues(p.zone, name, "rejected").Inc()
+		return
+	}
+	if !answered(errs...) {
+		return
+	}
+	tokenAuth.WithLabelValues(p.zone, name, "ok").Inc()
+	if p.useSecondary.Swap(secondary) == secondary {
+		return
+	}
+	if secondary {
+		clog.Warningf("ztnet: primary token rejected, zone %s refreshed with the secondary token", p.zone)
+		return
+	}
+	clog.Infof("ztnet: zone %s authenticated with the primary token again", p.zone)
+}
+
+// apiToken returns the token that last authenticated a refresh.
+func (p *ZtnetPlugin) apiToken() (string, error) {
+	if src := p.poller(); src.cfg.SecondaryToken.Source != "" && src.useSecondary.Load() {
+		return LoadToken(src.cfg.SecondaryToken)
+	}
+	return LoadToken(p.cfg.Token)
+}
+
+func (p *ZtnetPlugin) refresh(ctx context.Context) (err error) {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	defer func() {
+		p.status.record(err)
+		p.checkHealth()
+	}()
+	token, err := LoadToken(p.cfg.Token)
+	if err != nil {
+		tokenReload.WithLabelValues(p.zone, p.cfg.Token.Source, "error").Inc()
+		refreshCount.WithLabelValues(p.zone, "error").Inc()
+		return fmt.Errorf("load token: %w", err)
+	}
+	tokenReload.WithLabelValues(p.zone, p.cfg.Token.Source, "ok").Inc()
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	members, netinfo, membersErr, netErr := p.fetch(ctx, token)
+	rejected := unauthorized(membersErr, netErr)
+	if rejected {
+		// drop a cached token_command output so the next load runs the command again.
+		forgetCommandToken(p.cfg.Token)
+	}
+	if p.cfg.SecondaryToken.Source != "" {
+		p.recordTokenAuth(false, membersErr, netErr)
+		if rejected {
+			if token, err := LoadToken(p.cfg.SecondaryToken); err != nil {
+				clog.Errorf("ztnet: primary token rejected and secondary token unavailable: %v", err)
+			} else {
+				members, netinfo, membersErr, netErr = p.fetch(ctx, token)
+				if unauthorized(membersErr, netErr) {
+					forgetCommandToken(p.cfg.SecondaryToken)
+				}
+				p.recordTokenAuth(true, membersErr, netErr)
+			}
+		}
+	}
+	// keep each result as soon as it arrives: its validator is already stored, so a later
+	// 304 must rebuild from it even when the rest of this refresh fails.
+	if membersErr == nil {
+		p.lastMembers, p.lastBuilt = members, false
+	}
+	if netErr == nil {
+		p.lastNetwork, p.lastBuilt = netinfo, false
+	}
+	membersUnchanged := errors.Is(membersErr, ErrNotModified)
+	netUnchanged := errors.Is(netErr, ErrNotModified)
+	// both unchanged skips the rebuild only when the last one succeeded.
+	if membersUnchanged && netUnchanged && p.lastBuilt {
+		refreshCount.WithLabelValues(p.zone, "unchanged").Inc()
+		return nil
+	}
+	if membersUnchanged {
+		members, membersErr = p.lastMembers, nil
+	}
+	if netUnchanged {
+		netinfo, netErr = p.lastNetwork, nil
+	}
 	if membersErr != nil {
 		refreshCount.WithLabelValues(p.zone, "error").Inc()
-		if errors.Is(membersErr, ErrUnauthorized) {
+		switch {
+		case errors.Is(membersErr, ErrUnauthorized):
 			clog.Errorf("ztnet: unauthorized against API members endpoint")
+		case errors.Is(membersErr, ErrNotFound):
+			clog.Errorf("ztnet: network %s not found on API members endpoint", p.cfg.NetworkID)
 		}
 		return membersErr
 	}
 	if netErr != nil {
 		refreshCount.WithLabelValues(p.zone, "error").Inc()
-		if errors.Is(netErr, ErrUnauthorized) {
+		switch {
+		case errors.Is(netErr, ErrUnauthorized):
 			clog.Errorf("ztnet: unauthorized against API network endpoint")
+		case errors.Is(netErr, ErrNotFound):
+			clog.Errorf("ztnet: network %s not found on API network endpoint", p.cfg.NetworkID)
 		}
 		return netErr
 	}
 
 	a, aaaa := make(map[string][]net.IP), make(map[string][]net.IP)
+	var memberIPs []net.IP
+	idx := MemberIndex{ByIP: make(map[string]MemberIdentity), ByName: make(map[string]MemberIdentity)}
 	for _, m := range members {
 		nodeID := strings.ToLower(strings.TrimSpace(m.NodeID))
 		if nodeID == "" {
 			clog.Warningf("ztnet: member %q has empty nodeID, skipping", m.Name)
 			continue
 		}
+		id := MemberIdentity{NodeID: nodeID, Name: strings.TrimSpace(m.Name), Tags: m.Tags}
 		names := []string{dns.Fqdn(nodeID + "." + p.zone)}
 		if m.Name != "" {
-			normalizedName := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(m.Name), " ", "_"))
+			normalizedName := normalizeMemberName(m.Name)
 			candidate := normalizedName + "." + p.zone
-			if _, ok := dns.IsDomainName(candidate); ok {
+			if isReservedLabel(normalizedName) {
+				clog.Warningf("ztnet: member name %q is reserved, skipping name record", m.Name)
+			} else if _, ok := dns.IsDomainName(candidate); ok {
 				names = append(names, dns.Fqdn(candidate))
 			} else {
 				clog.Warningf("ztnet: member name %q is not a valid DNS label, skipping name record", m.Name)
 			}
 		}
+		for _, n := range names {
+			idx.ByName[n] = id
+		}
 		for _, ipStr := range m.IPAssignments {
 			ip := net.ParseIP(ipStr)
 			if ip == nil {
 				continue
 			}
+			idx.ByIP[memberIPKey(ip)] = id
+			memberIPs = append(memberIPs, ip)
 			for _, n := range names {
 				if ip.To4() != nil {
 					a[n] = append(a[n], ip.To4())
@@ -250,23 +561,32 @@ func (p *ZtnetPlugin) refresh(ctx context.Context) error {
 			}
 		}
 	}
-	cidrs := append([]string{}, p.cfg.AllowedCIDRs...)
-	if p.cfg.AutoAllowZT {
-		for _, rt := range netinfo.Config.Routes {
-			if rt.Via == nil && strings.TrimSpace(rt.Target) != "" {
-				cidrs = append(cidrs, rt.Target)
-			}
-		}
-	}
-	allowed, err := NewAllowedNets(cidrs)
+	allowed, err := p.buildAllowed(netinfo, memberIPs)
 	if err != nil {
 		refreshCount.WithLabelValues(p.zone, "error").Inc()
 		return fmt.Errorf("build allowlist: %w", err)
 	}
-	p.cache.Set(a, aaaa, allowed)
+	p.cache.SetWithMembers(a, aaaa, idx, allowed)
+	p.lastBuilt = true
 	ac, aaaac := p.cache.Counts()
 	entriesGauge.WithLabelValues(p.zone, "A").Set(float64(ac))
 	entriesGauge.WithLabelValues(p.zone, "AAAA").Set(float64(aaaac))
 	refreshCount.WithLabelValues(p.zone, "ok").Inc()
 	return nil
 }
+
+// buildAllowed builds the source allowlist for the configured acl_mode.
+func (p *ZtnetPlugin) buildAllowed(netinfo NetworkInfo, memberIPs []net.IP) (*AllowedNets, error) {
+	if p.cfg.ACLMode == ACLModeMembers {
+		return NewMemberAllowedNets(p.cfg.AllowedCIDRs, memberIPs)
+	}
+	cidrs := append([]string{}, p.cfg.AllowedCIDRs...)
+	if p.cfg.AutoAllowZT {
+		for _, rt := range netinfo.Config.Routes {
+			if rt.Via == nil && strings.TrimSpace(rt.Target) != "" {
+				cidrs = append(cidrs, rt.Target)
+			}
+		}
+	}
+	return NewAllowedNets(cidrs)
+}
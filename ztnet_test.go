@@ -2,7 +2,20 @@ package ztnet
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -16,8 +29,10 @@ import (
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/metadata"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type nextOK struct{}
@@ -148,6 +163,7 @@ func TestExtractSourceIP_TCP(t *testing.T) {
 type fakeRW struct {
 	remoteAddr net.Addr
 	msg        *dns.Msg
+	tsigErr    error
 }
 
 func (f *fakeRW) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53} }
@@ -155,7 +171,7 @@ func (f *fakeRW) RemoteAddr() net.Addr      { return f.remoteAddr }
 func (f *fakeRW) WriteMsg(m *dns.Msg) error { f.msg = m; return nil }
 func (f *fakeRW) Write([]byte) (int, error) { return 0, nil }
 func (f *fakeRW) Close() error              { return nil }
-func (f *fakeRW) TsigStatus() error         { return nil }
+func (f *fakeRW) TsigStatus() error         { return f.tsigErr }
 func (f *fakeRW) TsigTimersOnly(bool)       {}
 func (f *fakeRW) Hijack()                   {}
 
@@ -189,6 +205,8 @@ func TestParse(t *testing.T) {
 			name: "happy-path with all key params",
 			corefile: `ztnet {
 				api_url http://127.0.0.1:3000
+				api_proxy http://proxy.internal:3128
+				max_response_size 64M
 				network_id 17d395d8cb43a800
 				zone ZT.Example.COM
 				token_file /tmp/token
@@ -201,6 +219,26 @@ func TestParse(t *testing.T) {
 				strict_start true
 				search_domain CORP.EXAMPLE.COM
 				allow_short_names true
+				acl_mode members
+				rate_limit 20 40
+				rate_limit_prefix 24 56
+				rate_limit_slip 0
+				trusted_forwarders 192.168.55.1/32 fd00::53/128
+				trusted_proxies 172.16.0.0/12
+				client_ip_metadata proxy/client_ip
+				tsig_key Admin.Example. c2VjcmV0
+				webhook 127.0.0.1:8053 /run/secrets/ztnet_webhook
+				webhook_debounce 500ms
+				admin 127.0.0.1:8054 /run/secrets/ztnet_admin
+				stale_threshold 5m
+				wait_for_sync 20s warn
+				circuit_breaker 3 1m
+				max_backoff 10m
+				tls_ca /etc/ztnet/ca.pem
+				tls_cert /etc/ztnet/client.pem
+				tls_key /etc/ztnet/client.key
+				tls_server_name ztnet.internal
+				view tag:contractor tag:contractor build01
 			}`,
 			assertCfg: func(t *testing.T, cfg Config) {
 				t.Helper()
@@ -222,6 +260,68 @@ func TestParse(t *testing.T) {
 				if cfg.SearchDomain != "corp.example.com." {
 					t.Fatalf("expected normalized search_domain, got %q", cfg.SearchDomain)
 				}
+				if cfg.ACLMode != ACLModeMembers {
+					t.Fatalf("expected acl_mode members, got %q", cfg.ACLMode)
+				}
+				if cfg.RateLimit != (RateLimitConfig{Rate: 20, Burst: 40, IPv4Prefix: 24, IPv6Prefix: 56}) {
+					t.Fatalf("unexpected rate limit config: %#v", cfg.RateLimit)
+				}
+				if len(cfg.TrustedForwarders) != 2 || cfg.TrustedForwarders[0].String() != "192.168.55.1/32" {
+					t.Fatalf("unexpected trusted forwarders: %v", cfg.TrustedForwarders)
+				}
+				if len(cfg.TrustedProxies) != 1 || cfg.ClientIPMetadata != "proxy/client_ip" {
+					t.Fatalf("unexpected proxy config: %v %q", cfg.TrustedProxies, cfg.ClientIPMetadata)
+				}
+				if cfg.TSIGKeys["admin.example."] != "c2VjcmV0" {
+					t.Fatalf("unexpected tsig keys: %v", cfg.TSIGKeys)
+				}
+				if cfg.Webhook != (WebhookConfig{Addr: "127.0.0.1:8053", SecretFile: "/run/secrets/ztnet_webhook", Debounce: 500 * time.Millisecond}) {
+					t.Fatalf("unexpected webhook config: %#v", cfg.Webhook)
+				}
+				if cfg.Admin != (AdminConfig{Addr: "127.0.0.1:8054", TokenFile: "/run/secrets/ztnet_admin"}) {
+					t.Fatalf("unexpected admin config: %#v", cfg.Admin)
+				}
+				if cfg.WaitForSync != 20*time.Second || !cfg.WaitForSyncWarn {
+					t.Fatalf("unexpected wait_for_sync: %s warn=%v", cfg.WaitForSync, cfg.WaitForSyncWarn)
+				}
+				if cfg.StaleThreshold != 5*time.Minute {
+					t.Fatalf("unexpected stale_threshold: %s", cfg.StaleThreshold)
+				}
+				if cfg.TLS != (TLSConfig{CA: "/etc/ztnet/ca.pem", Cert: "/etc/ztnet/client.pem", Key: "/etc/ztnet/client.key", ServerName: "ztnet.internal"}) {
+					t.Fatalf("unexpected tls config: %#v", cfg.TLS)
+				}
+				if cfg.MaxResponseSize != 64<<20 {
+					t.Fatalf("unexpected max_response_size: %d", cfg.MaxResponseSize)
+				}
+				if cfg.APIProxy != "http://proxy.internal:3128" {
+					t.Fatalf("unexpected api_proxy: %q", cfg.APIProxy)
+				}
+				if cfg.Breaker != (BreakerConfig{Threshold: 3, Cooldown: time.Minute}) || cfg.MaxBackoff != 10*time.Minute {
+					t.Fatalf("unexpected breaker config: %#v max_backoff=%s", cfg.Breaker, cfg.MaxBackoff)
+				}
+				if len(cfg.Views) != 1 || cfg.Views[0].SourceTag != "contractor" || !slices.Equal(cfg.Views[0].Tags, []string{"contractor"}) || !slices.Equal(cfg.Views[0].Names, []string{"build01"}) {
+					t.Fatalf("unexpected views: %#v", cfg.Views)
+				}
+			},
+		},
+		{
+			name: "multiple api_url endpoints",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000 http://10.147.20.1:3000
+				api_url http://192.168.1.10:3000
+				api_probe_interval 2m
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+			}`,
+			assertCfg: func(t *testing.T, cfg Config) {
+				t.Helper()
+				if cfg.APIURL != "http://127.0.0.1:3000" {
+					t.Fatalf("expected first api_url as primary, got %q", cfg.APIURL)
+				}
+				if !slices.Equal(cfg.APIFallbackURLs, []string{"http://10.147.20.1:3000", "http://192.168.1.10:3000"}) || cfg.APIProbeInterval != 2*time.Minute {
+					t.Fatalf("unexpected fallback endpoints: %v probe=%s", cfg.APIFallbackURLs, cfg.APIProbeInterval)
+				}
 			},
 		},
 		{
@@ -254,6 +354,153 @@ func TestParse(t *testing.T) {
 			}`,
 			errText: "api_url, network_id and zone are required",
 		},
+		{
+			name: "invalid acl_mode",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				acl_mode everyone
+			}`,
+			errText: "acl_mode must be networks or members, got everyone",
+		},
+		{
+			name: "invalid rate_limit_prefix",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				rate_limit_prefix 33 64
+			}`,
+			errText: "rate_limit_prefix must be 0-32 and 0-128, got 33 64",
+		},
+		{
+			name: "dynamic_updates without tsig_key",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				dynamic_updates true
+			}`,
+			errText: "dynamic_updates requires at least one tsig_key",
+		},
+		{
+			name: "invalid refresh",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				refresh 0s
+			}`,
+			errText: "refresh must be > 0, got 0s",
+		},
+		{
+			name: "invalid circuit_breaker cooldown",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				circuit_breaker 5 0s
+			}`,
+			errText: "circuit_breaker cooldown must be > 0, got 0s",
+		},
+		{
+			name: "tls_cert without tls_key",
+			corefile: `ztnet {
+				api_url https://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				tls_cert /etc/ztnet/client.pem
+			}`,
+			errText: "tls_cert and tls_key must be set together",
+		},
+		{
+			name: "relative unix socket api_url",
+			corefile: `ztnet {
+				api_url unix://run/ztnet.sock
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+			}`,
+			errText: "api_url unix://run/ztnet.sock must be unix:///absolute/path.sock",
+		},
+		{
+			name: "invalid api_proxy scheme",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				api_proxy ftp://proxy:21
+			}`,
+			errText: `api_proxy parse: unsupported proxy scheme "ftp"`,
+		},
+		{
+			name: "token_command with ttl and timeout",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_command_ttl 1m
+				token_command vault kv get -field=token secret/ztnet
+				token_command_timeout 3s
+			}`,
+			assertCfg: func(t *testing.T, cfg Config) {
+				t.Helper()
+				want := []string{"vault", "kv", "get", "-field=token", "secret/ztnet"}
+				if cfg.Token.Source != TokenSourceCommand || !slices.Equal(cfg.Token.Command, want) || cfg.Token.CommandTTL != time.Minute || cfg.Token.CommandTimeout != 3*time.Second {
+					t.Fatalf("unexpected token config: %#v", cfg.Token)
+				}
+			},
+		},
+		{
+			name: "token_credential with a path",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_credential ../ztnet_token
+			}`,
+			errText: "token_credential must be a credential name, got ../ztnet_token",
+		},
+		{
+			name: "token_secondary command shares command settings",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /run/secrets/ztnet_token
+				token_secondary command cat /run/secrets/ztnet_token.prev
+				token_command_timeout 2s
+			}`,
+			assertCfg: func(t *testing.T, cfg Config) {
+				t.Helper()
+				sec := cfg.SecondaryToken
+				if sec.Source != TokenSourceCommand || !slices.Equal(sec.Command, []string{"cat", "/run/secrets/ztnet_token.prev"}) || sec.CommandTimeout != 2*time.Second || sec.CommandTTL != 5*time.Minute {
+					t.Fatalf("unexpected secondary token: %#v", sec)
+				}
+				if cfg.Token.Source != TokenSourceFile || cfg.Token.Value != "/run/secrets/ztnet_token" {
+					t.Fatalf("unexpected primary token: %#v", cfg.Token)
+				}
+			},
+		},
+		{
+			name: "invalid token_secondary source",
+			corefile: `ztnet {
+				api_url http://127.0.0.1:3000
+				network_id 17d395d8cb43a800
+				zone zt.example.com
+				token_file /tmp/token
+				token_secondary vault secret/ztnet
+			}`,
+			errText: "token_secondary source must be file, env, credential, command or inline, got vault",
+		},
 		{
 			name: "max_retries < 0",
 			corefile: `ztnet {
@@ -484,6 +731,89 @@ func TestLoadToken_HotRotation(t *testing.T) {
 	}
 }
 
+func TestLoadToken_Credential(t *testing.T) {
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "ztnet_token"), []byte("cred\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", d)
+	if tok, err := LoadToken(TokenConfig{Source: TokenSourceCredential, Value: "ztnet_token"}); err != nil || tok != "cred" {
+		t.Fatalf("%v %s", err, tok)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if _, err := LoadToken(TokenConfig{Source: TokenSourceCredential, Value: "ztnet_token"}); err == nil || !strings.Contains(err.Error(), "CREDENTIALS_DIRECTORY") {
+		t.Fatalf("expected missing CREDENTIALS_DIRECTORY error, got %v", err)
+	}
+}
+
+func TestLoadToken_CommandCachedAndTimeout(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	script := `echo x >> "$1"; echo " cmd-token "`
+	cfg := TokenConfig{Source: TokenSourceCommand, Command: []string{"sh", "-c", script, "sh", counter}, CommandTTL: time.Minute, CommandTimeout: 5 * time.Second}
+	cfg.Value = strings.Join(cfg.Command, " ")
+	for i := 0; i < 3; i++ {
+		if tok, err := LoadToken(cfg); err != nil || tok != "cmd-token" {
+			t.Fatalf("%v %q", err, tok)
+		}
+	}
+	if b, _ := os.ReadFile(counter); strings.Count(string(b), "x") != 1 {
+		t.Fatalf("expected one command run within the TTL, got %q", b)
+	}
+
+	failing := TokenConfig{Source: TokenSourceCommand, Value: "sh -c fail", Command: []string{"sh", "-c", "echo vault sealed >&2; exit 3"}, CommandTimeout: 5 * time.Second}
+	if _, err := LoadToken(failing); err == nil || !strings.Contains(err.Error(), "vault sealed") {
+		t.Fatalf("expected command stderr in error, got %v", err)
+	}
+	slow := TokenConfig{Source: TokenSourceCommand, Value: "sleep 5", Command: []string{"sleep", "5"}, CommandTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	if _, err := LoadToken(slow); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("expected token_command to be killed on timeout")
+	}
+}
+
+func TestLoadToken_CommandKeyedOnArgvAndKilledWithChildren(t *testing.T) {
+	spaced := TokenConfig{Source: TokenSourceCommand, Command: []string{"printf", "%s|", "a b"}, CommandTTL: time.Minute, CommandTimeout: 5 * time.Second}
+	split := TokenConfig{Source: TokenSourceCommand, Command: []string{"printf", "%s|", "a", "b"}, CommandTTL: time.Minute, CommandTimeout: 5 * time.Second}
+	spaced.Value, split.Value = strings.Join(spaced.Command, " "), strings.Join(split.Command, " ")
+	if tok, err := LoadToken(spaced); err != nil || tok != "a b|" {
+		t.Fatalf("%v %q", err, tok)
+	}
+	if tok, err := LoadToken(split); err != nil || tok != "a|b|" {
+		t.Fatalf("expected argv with the same command line not to share the cache, got %v %q", err, tok)
+	}
+
+	forked := TokenConfig{Source: TokenSourceCommand, Value: "sh -c sleep", Command: []string{"sh", "-c", "sleep 5; echo late"}, CommandTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := LoadToken(forked); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected a command with a running child to return promptly on timeout, took %s", elapsed)
+	}
+}
+
+func TestRefresh_RejectedCommandTokenIsNotReused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	counter := filepath.Join(t.TempDir(), "runs")
+	cmd := []string{"sh", "-c", `echo x >> "$1"; echo tok`, "sh", counter}
+	cfg := Config{Token: TokenConfig{Source: TokenSourceCommand, Value: strings.Join(cmd, " "), Command: cmd, CommandTTL: time.Hour, CommandTimeout: 5 * time.Second}, Timeout: time.Second}
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: cfg, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	for i := 0; i < 2; i++ {
+		if err := p.refresh(context.Background()); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("expected unauthorized, got %v", err)
+		}
+	}
+	if b, _ := os.ReadFile(counter); strings.Count(string(b), "x") != 2 {
+		t.Fatalf("expected the command to run again after a rejection, got %q", b)
+	}
+}
+
 func TestLoadToken_File_Empty(t *testing.T) {
 	fp := filepath.Join(t.TempDir(), "tok")
 	if err := os.WriteFile(fp, []byte(" \n\t "), 0o600); err != nil {
@@ -771,8 +1101,8 @@ func TestFetchMembers_RetryStopsOnContextTimeout(t *testing.T) {
 
 	start := time.Now()
 	_, err := c.FetchMembers(ctx, "t")
-	if !errors.Is(err, context.DeadlineExceeded) {
-		t.Fatalf("expected deadline exceeded, got %v", err)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected deadline exceeded timeout, got %v", err)
 	}
 	if got := calls.Load(); got != 1 {
 		t.Fatalf("expected 1 call before timeout during retry wait, got %d", got)
@@ -827,408 +1157,2252 @@ func TestFetchNetwork_RetryStopsOnContextCancel(t *testing.T) {
 	}
 }
 
-func TestAPIClient_RetryDelayAndContextHandling(t *testing.T) {
-	c := &APIClient{MaxRetries: 10, Jitter: func(max time.Duration) time.Duration {
-		if max <= 0 {
-			t.Fatalf("unexpected jitter max: %s", max)
+func TestAPIClient_CircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
-		return max
-	}}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
 
-	if got, want := c.retryDelay(0), 150*time.Millisecond; got != want {
-		t.Fatalf("attempt 0 delay: got %s, want %s", got, want)
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker("breaker.test.", BreakerConfig{Threshold: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+	c := &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), Breaker: b}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.FetchNetwork(context.Background(), "tok"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: expected upstream error, got %v", i, err)
+		}
 	}
-	if got, want := c.retryDelay(4), 2400*time.Millisecond; got != want {
-		t.Fatalf("attempt 4 delay with cap: got %s, want %s", got, want)
+	if _, err := c.FetchNetwork(context.Background(), "tok"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected open breaker to skip the API, got %d calls", calls.Load())
+	}
+	if got := testutil.ToFloat64(breakerGauge.WithLabelValues("breaker.test.")); got != breakerOpen {
+		t.Fatalf("expected open state metric, got %v", got)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-	if err := waitRetry(ctx, time.Second); !errors.Is(err, context.Canceled) {
-		t.Fatalf("expected context canceled from waitRetry, got %v", err)
+	// a failed probe after the cooldown reopens the breaker straight away.
+	now = now.Add(time.Minute)
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected half-open probe to reach the API, got %v", err)
+	}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected breaker reopened after failed probe, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	down.Store(false)
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
+		t.Fatalf("expected probe success, got %v", err)
+	}
+	if got := testutil.ToFloat64(breakerGauge.WithLabelValues("breaker.test.")); got != breakerClosed {
+		t.Fatalf("expected closed state metric, got %v", got)
 	}
 }
 
-func TestRefresh_TokenRotation(t *testing.T) {
-	var seenMu sync.Mutex
-	seen := make([]string, 0, 4)
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		seenMu.Lock()
-		seen = append(seen, r.Header.Get("x-ztnet-auth"))
-		seenMu.Unlock()
-		if r.URL.Path == "/api/v1/network/n/member" {
-			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
-			return
-		}
-		if r.URL.Path == "/api/v1/network/n" {
-			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+func TestAPIClient_EndpointFailover(t *testing.T) {
+	var primaryDown atomic.Bool
+	primaryDown.Store(true)
+	var primaryCalls, fallbackCalls atomic.Int32
+	network := func(w http.ResponseWriter) { _, _ = w.Write([]byte(`{"config":{"routes":[]}}`)) }
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls.Add(1)
+		if primaryDown.Load() {
+			w.WriteHeader(http.StatusBadGateway)
 			return
 		}
-		w.WriteHeader(404)
+		network(w)
 	}))
-	defer ts.Close()
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls.Add(1)
+		network(w)
+	}))
+	defer fallback.Close()
 
-	tf := filepath.Join(t.TempDir(), "tok")
-	if err := os.WriteFile(tf, []byte("tok-a"), 0o600); err != nil {
-		t.Fatal(err)
+	c := &APIClient{BaseURL: primary.URL, FallbackURLs: []string{fallback.URL}, NetworkID: "n", HTTPClient: &http.Client{}, Zone: "failover.test."}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
+		t.Fatalf("expected failover to succeed, got %v", err)
 	}
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "file", Value: tf}, Timeout: time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
-	if err := p.refresh(context.Background()); err != nil {
-		t.Fatal(err)
+	if primaryCalls.Load() != 1 || fallbackCalls.Load() != 1 {
+		t.Fatalf("expected one call per endpoint, got %d/%d", primaryCalls.Load(), fallbackCalls.Load())
 	}
-	if err := os.WriteFile(tf, []byte("tok-b"), 0o600); err != nil {
+	// the healthy endpoint is remembered.
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
 		t.Fatal(err)
 	}
-	if err := p.refresh(context.Background()); err != nil {
-		t.Fatal(err)
+	if primaryCalls.Load() != 1 || fallbackCalls.Load() != 2 {
+		t.Fatalf("expected fallback to stay active, got %d/%d", primaryCalls.Load(), fallbackCalls.Load())
 	}
-
-	seenMu.Lock()
-	defer seenMu.Unlock()
-	if !slices.Contains(seen, "tok-a") || !slices.Contains(seen, "tok-b") {
-		t.Fatalf("expected both tokens to be used, got %v", seen)
+	if got := testutil.ToFloat64(apiCallCount.WithLabelValues("failover.test.", primary.URL, "error")); got != 1 {
+		t.Fatalf("expected primary failure counted, got %v", got)
 	}
-}
-
-func TestRefresh_AutoCIDRFromRoutes(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/v1/network/n/member" {
-			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
-			return
-		}
-		if r.URL.Path == "/api/v1/network/n" {
-			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.55.0.0/16","via":null}]}}`))
-			return
-		}
-		w.WriteHeader(404)
-	}))
-	defer ts.Close()
 
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
-	if err := p.refresh(context.Background()); err != nil {
+	c.probe(context.Background(), "tok")
+	if c.active != 1 {
+		t.Fatal("expected failed probe to keep the fallback active")
+	}
+	primaryDown.Store(false)
+	c.probe(context.Background(), "tok")
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
 		t.Fatal(err)
 	}
-	if !p.cache.IsAllowed(net.ParseIP("10.55.1.20"), true) {
-		t.Fatal("expected auto route CIDR to be allowed")
+	if primaryCalls.Load() != 4 || fallbackCalls.Load() != 2 {
+		t.Fatalf("expected probe to switch back to the primary, got %d/%d", primaryCalls.Load(), fallbackCalls.Load())
 	}
 }
 
-func TestRefresh_SkipsViaRoutes(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/v1/network/n/member" {
-			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
-			return
-		}
-		if r.URL.Path == "/api/v1/network/n" {
-			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.77.0.0/16","via":"10.0.0.1"}]}}`))
-			return
-		}
-		w.WriteHeader(404)
+func TestAPIClient_EndpointFailoverOnConnectionError(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
 	}))
-	defer ts.Close()
+	defer up.Close()
 
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
-	if err := p.refresh(context.Background()); err != nil {
-		t.Fatal(err)
+	c := &APIClient{BaseURL: down.URL, FallbackURLs: []string{up.URL}, NetworkID: "n", HTTPClient: &http.Client{}}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
+		t.Fatalf("expected failover after connection error, got %v", err)
 	}
-	if p.cache.IsAllowed(net.ParseIP("10.77.1.20"), true) {
+}
+
+// writeTestCert issues a certificate signed by parent (self-signed when nil) and writes PEM cert/key files.
+func writeTestCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestConfigureTLS_CAClientCertAndReload(t *testing.T) {
+	dir := t.TempDir()
+	caTmpl := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	}
+	ca := writeTestCert(t, dir, "ca", caTmpl("ztnet test ca"), nil)
+	other := writeTestCert(t, dir, "other", caTmpl("other ca"), nil)
+	srvCert := writeTestCert(t, dir, "server", &x509.Certificate{DNSNames: []string{"ztnet.internal"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, &ca)
+	writeTestCert(t, dir, "client", &x509.Certificate{Subject: pkix.Name{CommonName: "coredns"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, &ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	cfg := TLSConfig{CA: filepath.Join(dir, "ca.crt"), Cert: filepath.Join(dir, "client.crt"), Key: filepath.Join(dir, "client.key"), ServerName: "ztnet.internal"}
+	client := func(cfg TLSConfig) (*APIClient, error) {
+		tr := &http.Transport{DisableKeepAlives: true}
+		if err := configureTLS(tr, cfg); err != nil {
+			return nil, err
+		}
+		return &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: &http.Client{Transport: tr}}, nil
+	}
+	fetch := func(cfg TLSConfig) error {
+		c, err := client(cfg)
+		if err != nil {
+			return err
+		}
+		_, err = c.FetchNetwork(context.Background(), "tok")
+		return err
+	}
+	if err := fetch(cfg); err != nil {
+		t.Fatalf("expected verified mTLS request, got %v", err)
+	}
+	noName := cfg
+	noName.ServerName = ""
+	if err := fetch(noName); err == nil {
+		t.Fatal("expected name mismatch without tls_server_name")
+	}
+	noCert := cfg
+	noCert.Cert, noCert.Key = "", ""
+	if err := fetch(noCert); err == nil {
+		t.Fatal("expected server to reject a client without certificate")
+	}
+	if err := fetch(TLSConfig{Insecure: true, Cert: cfg.Cert, Key: cfg.Key}); err != nil {
+		t.Fatalf("expected tls_insecure to skip verification, got %v", err)
+	}
+
+	// rotating the CA file is picked up on the next handshake.
+	c, err := client(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.CA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Leaf.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(cfg.CA, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); err == nil {
+		t.Fatal("expected rotated CA to reject the old server certificate")
+	}
+}
+
+func TestConfigureTLS_HTTPSProxyIgnoresAPIOptions(t *testing.T) {
+	var sni atomic.Value
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni.Store(hello.ServerName)
+		return nil, nil
+	}}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxy.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(proxy.Listener.Addr().String())
+	cfg := Config{APIURL: "https://ztnet.example", APIProxy: "https://localhost:" + port, Timeout: time.Second, TLS: TLSConfig{CA: ca, ServerName: "ztnet.internal"}}
+	tr, err := newAPITransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &APIClient{BaseURL: cfg.APIURL, NetworkID: "n", HTTPClient: &http.Client{Transport: tr}}
+	_, _ = c.FetchNetwork(context.Background(), "tok")
+	// the proxy certificate is not publicly trusted, so only the handshake is checked.
+	if got, _ := sni.Load().(string); got != "localhost" {
+		t.Fatalf("expected the proxy handshake to name the proxy host, got %q", got)
+	}
+}
+
+func TestNewAPITransport_UnixSocketAndProxy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ztsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "api.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/network/n" || r.Header.Get("x-ztnet-auth") != "tok" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		if r.URL.Host != "ztnet.example:3000" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer proxy.Close()
+
+	cfg := Config{APIURL: "unix://" + socket, APIFallbackURLs: []string{"http://ztnet.example:3000"}, APIProxy: proxy.URL, Timeout: time.Second}
+	tr, err := newAPITransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := &APIClient{BaseURL: cfg.APIURL, NetworkID: "n", HTTPClient: &http.Client{Transport: tr}}
+	info, err := unix.FetchNetwork(context.Background(), "tok")
+	if err != nil || len(info.Config.Routes) != 1 {
+		t.Fatalf("expected network over unix socket, got %#v err=%v", info, err)
+	}
+	if proxied.Load() != 0 {
+		t.Fatal("expected unix socket requests to bypass the proxy")
+	}
+	viaProxy := &APIClient{BaseURL: cfg.APIFallbackURLs[0], NetworkID: "n", HTTPClient: &http.Client{Transport: tr}}
+	if _, err := viaProxy.FetchNetwork(context.Background(), "tok"); err != nil || proxied.Load() != 1 {
+		t.Fatalf("expected request through api_proxy, got err=%v proxied=%d", err, proxied.Load())
+	}
+
+	cfg.APIProxy = APIProxyNone
+	tr, err = newAPITransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Proxy != nil {
+		t.Fatal("expected api_proxy none to disable proxying")
+	}
+}
+
+func TestFetchMembers_PaginationAndSizeLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("ETag", `"p1"`)
+			w.Header().Set("Link", `</api/v1/network/n/member?page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv1","authorized":true,"ipAssignments":["10.0.0.1"]},{"nodeId":"x","name":"off","authorized":false}]`))
+		case "2":
+			w.Header().Set("Link", `<http://elsewhere.example/api/v1/network/n/member?page=3>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"b","name":"srv2","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+		default:
+			_, _ = w.Write([]byte(`[{"nodeId":"c","name":"srv3","authorized":true,"ipAssignments":["10.0.0.3"]}]`))
+		}
+	}))
+	defer ts.Close()
+
+	c := &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}
+	members, err := c.FetchMembers(context.Background(), "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 || members[0].NodeID != "a" || members[2].NodeID != "c" {
+		t.Fatalf("expected authorized members from all pages, got %#v", members)
+	}
+	if v := c.validator("/api/v1/network/n/member"); v != (cacheValidator{}) {
+		t.Fatalf("expected paginated response not to be revalidated, got %#v", v)
+	}
+
+	c.MaxResponseBytes = 64
+	if _, err := c.FetchMembers(context.Background(), "tok"); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected response too large, got %v", err)
+	}
+}
+
+func TestFetchMembers_PaginationUnderPathPrefix(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ztnet/api/v1/network/n/member" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</ztnet/api/v1/network/n/member?page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","authorized":true}]`))
+		case "2":
+			w.Header().Set("Link", `<member?page=3>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"b","authorized":true}]`))
+		default:
+			_, _ = w.Write([]byte(`[{"nodeId":"c","authorized":true}]`))
+		}
+	}))
+	defer ts.Close()
+
+	c := &APIClient{BaseURL: ts.URL + "/ztnet/", NetworkID: "n", HTTPClient: ts.Client()}
+	members, err := c.FetchMembers(context.Background(), "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 || members[2].NodeID != "c" {
+		t.Fatalf("expected every page under the api_url path, got %#v", members)
+	}
+}
+
+func TestRefresh_PaginatedMembersNeverRevalidated(t *testing.T) {
+	var conditional atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+			return
+		}
+		etag := `"p` + r.URL.Query().Get("page") + `"`
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			conditional.Add(1)
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `</api/v1/network/n/member?page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv1","authorized":true,"ipAssignments":["10.0.0.1"]}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"nodeId":"b","name":"srv2","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	for i := 0; i < 3; i++ {
+		if err := p.refresh(context.Background()); err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+		if len(p.cache.LookupA("srv1.zt.example.com.")) != 1 || len(p.cache.LookupA("srv2.zt.example.com.")) != 1 {
+			t.Fatalf("refresh %d: expected members from both pages", i)
+		}
+	}
+	if got := conditional.Load(); got != 0 {
+		t.Fatalf("expected no conditional member requests for a paginated list, got %d", got)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"1024": 1024, "64K": 64 << 10, "10M": 10 << 20, "1G": 1 << 30} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Fatalf("parseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0", "-1M", "10MB", "M"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestAPIClient_TypedErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/network/ratelimited":
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/api/v1/network/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/v1/network/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/api/v1/network/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/api/v1/network/garbage":
+			_, _ = w.Write([]byte(`{"config":`))
+		default:
+			w.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		network string
+		class   error
+		label   string
+		status  int
+	}{
+		{"ratelimited", ErrRateLimited, "rate_limited", http.StatusTooManyRequests},
+		{"missing", ErrNotFound, "not_found", http.StatusNotFound},
+		{"broken", ErrServer, "server", http.StatusInternalServerError},
+		{"forbidden", ErrUnauthorized, "unauthorized", http.StatusForbidden},
+		{"garbage", ErrDecode, "decode", 0},
+		{"teapot", ErrClient, "client", http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		c := &APIClient{BaseURL: ts.URL, NetworkID: tt.network, HTTPClient: ts.Client(), Zone: "errors.test."}
+		before := testutil.ToFloat64(apiErrCount.WithLabelValues("errors.test.", ts.URL, tt.label))
+		_, err := c.FetchNetwork(context.Background(), "tok")
+		if !errors.Is(err, tt.class) {
+			t.Fatalf("%s: expected %v, got %v", tt.network, tt.class, err)
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Status != tt.status || apiErr.Path != "/api/v1/network/"+tt.network || apiErr.Endpoint != ts.URL {
+			t.Fatalf("%s: unexpected api error %#v", tt.network, apiErr)
+		}
+		if got := testutil.ToFloat64(apiErrCount.WithLabelValues("errors.test.", ts.URL, tt.label)); got != before+1 {
+			t.Fatalf("%s: expected %s error counted, got %v", tt.network, tt.label, got)
+		}
+	}
+
+	ts.Close()
+	c := &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: &http.Client{}, Zone: "errors.test."}
+	if _, err := c.FetchNetwork(context.Background(), "tok"); !errors.Is(err, ErrTransport) {
+		t.Fatalf("expected transport error, got %v", err)
+	}
+	if testutil.CollectAndCount(apiDuration) == 0 {
+		t.Fatal("expected request durations observed")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	noJitter := func(time.Duration) time.Duration { return 0 }
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{10, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoffDelay(30*time.Second, 5*time.Minute, tt.failures, noJitter); got != tt.want {
+			t.Fatalf("failures=%d: got %s want %s", tt.failures, got, tt.want)
+		}
+	}
+	maxJitter := func(d time.Duration) time.Duration { return d }
+	if got := backoffDelay(30*time.Second, 5*time.Minute, 1, maxJitter); got != 75*time.Second {
+		t.Fatalf("expected jitter added, got %s", got)
+	}
+	if got := backoffDelay(30*time.Second, 5*time.Minute, 4, maxJitter); got != 5*time.Minute {
+		t.Fatalf("expected jitter capped at max_backoff, got %s", got)
+	}
+	if got := backoffDelay(30*time.Second, 0, 3, maxJitter); got != 30*time.Second {
+		t.Fatalf("expected max_backoff 0 to disable backoff, got %s", got)
+	}
+}
+
+func TestAPIClient_RetryDelayAndContextHandling(t *testing.T) {
+	c := &APIClient{MaxRetries: 10, Jitter: func(max time.Duration) time.Duration {
+		if max <= 0 {
+			t.Fatalf("unexpected jitter max: %s", max)
+		}
+		return max
+	}}
+
+	if got, want := c.retryDelay(0), 150*time.Millisecond; got != want {
+		t.Fatalf("attempt 0 delay: got %s, want %s", got, want)
+	}
+	if got, want := c.retryDelay(4), 2400*time.Millisecond; got != want {
+		t.Fatalf("attempt 4 delay with cap: got %s, want %s", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitRetry(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled from waitRetry, got %v", err)
+	}
+}
+
+func TestRefresh_TokenRotation(t *testing.T) {
+	var seenMu sync.Mutex
+	seen := make([]string, 0, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenMu.Lock()
+		seen = append(seen, r.Header.Get("x-ztnet-auth"))
+		seenMu.Unlock()
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	tf := filepath.Join(t.TempDir(), "tok")
+	if err := os.WriteFile(tf, []byte("tok-a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "file", Value: tf}, Timeout: time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tf, []byte("tok-b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	if !slices.Contains(seen, "tok-a") || !slices.Contains(seen, "tok-b") {
+		t.Fatalf("expected both tokens to be used, got %v", seen)
+	}
+}
+
+func TestRefresh_AutoCIDRFromRoutes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.55.0.0/16","via":null}]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.cache.IsAllowed(net.ParseIP("10.55.1.20"), true) {
+		t.Fatal("expected auto route CIDR to be allowed")
+	}
+}
+
+func TestRefresh_SkipsViaRoutes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.77.0.0/16","via":"10.0.0.1"}]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.cache.IsAllowed(net.ParseIP("10.77.1.20"), true) {
 		t.Fatal("expected via route CIDR to be skipped")
 	}
 }
 
-func TestRefresh_StaleAllowedOnBuildError(t *testing.T) {
-	var invalid atomic.Bool
+func TestRefresh_StaleAllowedOnBuildError(t *testing.T) {
+	var invalid atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			if invalid.Load() {
+				_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"not-cidr","via":null}]}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.66.0.0/16","via":null}]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	invalid.Store(true)
+	if err := p.refresh(context.Background()); err == nil {
+		t.Fatal("expected build allowlist error")
+	}
+	if !p.cache.IsAllowed(net.ParseIP("10.66.1.20"), true) {
+		t.Fatal("expected stale allowlist to remain on build error")
+	}
+	if len(p.cache.LookupA("srv.zt.example.com.")) == 0 {
+		t.Fatal("expected stale DNS records to remain on build error")
+	}
+}
+
+func TestCache_SetIsAllowed_Atomic(t *testing.T) {
+	rc := NewRecordCache()
+	rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.0.1")}}, nil, mustAllowed(t, "10.0.0.0/24"))
+
+	for i := 0; i < 2000; i++ {
+		if i%2 == 0 {
+			rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.0.1")}}, nil, mustAllowed(t, "10.0.0.0/24"))
+		} else {
+			rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.1.1")}}, nil, mustAllowed(t, "10.0.1.0/24"))
+		}
+		s := rc.load()
+		ips := s.a["srv."]
+		if len(ips) == 0 {
+			continue
+		}
+		if s.allowed == nil || !s.allowed.Contains(ips[0]) {
+			t.Fatal("observed non-atomic record/allowlist snapshot")
+		}
+	}
+}
+
+func TestServeDNS_REFUSED_NilSrcIP(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for nil src ip, got %d", rcode)
+	}
+}
+
+func TestServeDNS_NilAllowlist_StrictOff(t *testing.T) {
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{TTL: 60, StrictStart: false}, cache: NewRecordCache(), Next: nextOK{}}
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("missing.zt.example.com.", dns.TypeA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeNameError || len(rw.msg.Ns) == 0 {
+		t.Fatalf("expected NXDOMAIN with SOA, got rcode=%d ns=%d", rcode, len(rw.msg.Ns))
+	}
+}
+
+func TestServeDNS_ANY(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeANY)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 2 {
+		t.Fatalf("expected both A and AAAA answers, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+}
+
+func TestServeDNS_SOA(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+
+	apexReq := new(dns.Msg)
+	apexReq.SetQuestion("zt.example.com.", dns.TypeSOA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, apexReq)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected apex SOA answer, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+	if _, ok := rw.msg.Answer[0].(*dns.SOA); !ok {
+		t.Fatalf("expected SOA answer, got %T", rw.msg.Answer[0])
+	}
+
+	nonexistentReq := new(dns.Msg)
+	nonexistentReq.SetQuestion("anything.zt.example.com.", dns.TypeSOA)
+	rcode, _ = p.ServeDNS(context.Background(), rw, nonexistentReq)
+	if rcode != dns.RcodeNameError || len(rw.msg.Ns) != 1 || len(rw.msg.Answer) != 0 {
+		t.Fatalf("expected NXDOMAIN with SOA in authority, got rcode=%d ns=%d answer=%d", rcode, len(rw.msg.Ns), len(rw.msg.Answer))
+	}
+	if _, ok := rw.msg.Ns[0].(*dns.SOA); !ok {
+		t.Fatalf("expected SOA in authority, got %T", rw.msg.Ns[0])
+	}
+}
+
+func TestServeDNS_OutOfZone(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("google.com.", dns.TypeA)
+	rcode, err := p.ServeDNS(context.Background(), rw, req)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected passthrough success, got rcode=%d err=%v", rcode, err)
+	}
+	if rw.msg != nil {
+		t.Fatal("out-of-zone query should be handled by next plugin")
+	}
+}
+
+func TestServeDNS_NoQuestion(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	rcode, err := p.ServeDNS(context.Background(), rw, new(dns.Msg))
+	if err != nil || rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got rcode=%d err=%v", rcode, err)
+	}
+}
+
+func TestServeDNS_DNSSD_TXT(t *testing.T) {
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{TTL: 60, SearchDomain: "corp.example.com."}, cache: NewRecordCache(), Next: nextOK{}}
+	p.cache.Set(nil, nil, mustAllowed(t, "10.147.0.0/16"))
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("_dns-sd._udp.zt.example.com.", dns.TypeTXT)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("expected TXT answer, got rcode=%d", rcode)
+	}
+	assertDNSSDTXTPath(t, rw.msg, "corp.example.com.")
+}
+
+func TestServeDNS_ShortName_Hit(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.", dns.TypeA)
+	rcode, err := p.ServeDNS(context.Background(), rw, req)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected short-name hit, got rcode=%d err=%v", rcode, err)
+	}
+	if rw.msg == nil || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected one short-name answer, got %d", len(rw.msg.Answer))
+	}
+}
+
+func TestServeDNS_ShortName_Miss(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("unknown.", dns.TypeA)
+	rcode, err := p.ServeDNS(context.Background(), rw, req)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected passthrough for missing short-name, got rcode=%d err=%v", rcode, err)
+	}
+	if rw.msg != nil {
+		t.Fatal("missing short-name should pass to next plugin")
+	}
+}
+
+func TestServeDNS_ShortName_Off(t *testing.T) {
+	p := basePlugin(t)
+	p.cfg.AllowShort = false
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.", dns.TypeA)
+	rcode, err := p.ServeDNS(context.Background(), rw, req)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected out-of-zone passthrough when short names disabled, got rcode=%d err=%v", rcode, err)
+	}
+	if rw.msg != nil {
+		t.Fatal("short name should stay out-of-zone and pass to next plugin")
+	}
+}
+
+func TestServeDNS_AllowShort_DoesNotChangeInZoneMiss(t *testing.T) {
+	p := basePlugin(t)
+	p.cfg.AllowShort = true
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("unknown.zt.example.com.", dns.TypeA)
+	rcode, err := p.ServeDNS(context.Background(), rw, req)
+	if err != nil || rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN for in-zone miss, got rcode=%d err=%v", rcode, err)
+	}
+	if rw.msg == nil || len(rw.msg.Ns) == 0 {
+		t.Fatal("expected SOA in authority for in-zone miss")
+	}
+}
+
+func TestServeDNS_DNSSD_Custom(t *testing.T) {
+	p := basePlugin(t)
+	p.cfg.SearchDomain = "corp.example."
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("_dns-sd._udp.zt.example.com.", dns.TypeTXT)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("expected TXT answer for custom search domain, got rcode=%d", rcode)
+	}
+	assertDNSSDTXTPath(t, rw.msg, "corp.example.")
+}
+
+func TestServeDNS_Allowed_ZT(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.99.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("expected allowed ZT query, got rcode=%d", rcode)
+	}
+}
+
+func TestServeDNS_Allowed_Loopback(t *testing.T) {
+	p := basePlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("expected loopback to be allowed, got rcode=%d", rcode)
+	}
+}
+
+func TestIsBareName(t *testing.T) {
+	if !isBareName("host.") {
+		t.Fatal("expected host. to be bare")
+	}
+	if isBareName("host.zt.example.com.") {
+		t.Fatal("expected fqdn with zone not to be bare")
+	}
+}
+
+func TestRefresh_ConditionalRequestsSkipRebuild(t *testing.T) {
+	var networkChanged atomic.Bool
+	var conditional atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/network/n/member":
+			if r.Header.Get("If-None-Match") == `"m1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"m1"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+		case "/api/v1/network/n":
+			if !networkChanged.Load() && r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	serial := p.cache.Serial()
+	unchanged := testutil.ToFloat64(refreshCount.WithLabelValues(p.zone, "unchanged"))
+
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("unchanged refresh: %v", err)
+	}
+	if conditional.Load() != 2 {
+		t.Fatalf("expected both requests answered 304, got %d", conditional.Load())
+	}
+	if p.cache.Serial() != serial {
+		t.Fatal("expected snapshot not rebuilt when nothing changed")
+	}
+	if got := testutil.ToFloat64(refreshCount.WithLabelValues(p.zone, "unchanged")); got != unchanged+1 {
+		t.Fatalf("expected unchanged refresh counted, got %v want %v", got, unchanged+1)
+	}
+
+	networkChanged.Store(true)
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("partial refresh: %v", err)
+	}
+	if got := p.cache.LookupA("srv.zt.example.com."); len(got) != 1 {
+		t.Fatalf("expected cached members reused on partial 304, got %v", got)
+	}
+	if !p.cache.IsAllowed(net.ParseIP("10.0.0.9"), false) {
+		t.Fatal("expected allowlist rebuilt from changed network")
+	}
+}
+
+func TestRefresh_ConditionalMembersKeptAcrossFailedRefresh(t *testing.T) {
+	var name atomic.Value
+	name.Store("old")
+	var networkDown atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/network/n/member":
+			etag := `"` + name.Load().(string) + `"`
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"` + name.Load().(string) + `","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+		case "/api/v1/network/n":
+			if networkDown.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	name.Store("new")
+	networkDown.Store(true)
+	if err := p.refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh to fail while the network endpoint is down")
+	}
+	networkDown.Store(false)
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.cache.LookupA("new.zt.example.com.")) != 1 || len(p.cache.LookupA("old.zt.example.com.")) != 0 {
+		t.Fatal("expected the rename fetched during the failed refresh to be served after a 304")
+	}
+}
+
+func TestRefresh_ConditionalRebuildsAfterFailedBuild(t *testing.T) {
+	var conditional atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/network/n/member":
+			if r.Header.Get("If-None-Match") == `"m1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"m1"`)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+		case "/api/v1/network/n":
+			if r.Header.Get("If-None-Match") == `"n1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"n1"`)
+			_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AllowedCIDRs: []string{"not-cidr"}}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "build allowlist") {
+		t.Fatalf("expected the allowlist build to fail, got %v", err)
+	}
+	if err := p.refresh(context.Background()); err == nil {
+		t.Fatal("expected an unchanged refresh to retry the failed build")
+	}
+	if conditional.Load() != 2 || p.Ready() {
+		t.Fatalf("expected both requests answered 304 and the plugin not ready, got %d conditional", conditional.Load())
+	}
+
+	p.cfg.AllowedCIDRs = nil
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.cache.LookupA("srv.zt.example.com.")) != 1 || !p.Ready() {
+		t.Fatal("expected the snapshot built from the unchanged responses")
+	}
+}
+
+func TestRefresh_SecondaryTokenFallback(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("new")
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("x-ztnet-auth") != accepted.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
+
+	zone := "secondary.test."
+	p := &ZtnetPlugin{zone: zone, cfg: Config{Token: TokenConfig{Source: TokenSourceInline, Value: "new"}, SecondaryToken: TokenConfig{Source: TokenSourceInline, Value: "old"}, Timeout: time.Second, AllowedCIDRs: []string{"10.0.0.0/24"}}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := p.apiToken(); tok != "new" {
+		t.Fatalf("expected primary token in use, got %q", tok)
+	}
+
+	// ZTNET has not accepted the rotated primary yet.
+	accepted.Store("old")
+	rejected := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "rejected"))
+	secondaryOK := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "secondary", "ok"))
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("expected secondary token to succeed, got %v", err)
+	}
+	if got := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "rejected")); got != rejected+1 {
+		t.Fatalf("expected primary rejection counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "secondary", "ok")); got != secondaryOK+1 {
+		t.Fatalf("expected secondary success counted, got %v", got-secondaryOK)
+	}
+	if tok, _ := p.apiToken(); tok != "old" {
+		t.Fatalf("expected secondary token used for API calls, got %q", tok)
+	}
+	if len(p.cache.LookupA("srv.secondary.test.")) != 1 {
+		t.Fatal("expected snapshot built with the secondary token")
+	}
+
+	// an outage says nothing about the primary token.
+	down.Store(true)
+	primaryOK := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "ok"))
+	if err := p.refresh(context.Background()); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected server error during the outage, got %v", err)
+	}
+	if got := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "ok")); got != primaryOK {
+		t.Fatalf("expected no primary success counted during the outage, got %v", got-primaryOK)
+	}
+	if tok, _ := p.apiToken(); tok != "old" {
+		t.Fatalf("expected the secondary token kept during the outage, got %q", tok)
+	}
+	down.Store(false)
+
+	accepted.Store("none")
+	secondaryRejected := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "secondary", "rejected"))
+	if err := p.refresh(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized when both tokens are rejected, got %v", err)
+	}
+	if got := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "secondary", "rejected")); got != secondaryRejected+1 {
+		t.Fatalf("expected secondary rejection counted, got %v", got-secondaryRejected)
+	}
+
+	t.Setenv("ZTNET_TEST_UNSET_SECONDARY", "")
+	p.cfg.SecondaryToken = TokenConfig{Source: TokenSourceEnv, Value: "ZTNET_TEST_UNSET_SECONDARY"}
+	rejected = testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "rejected"))
+	if err := p.refresh(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized when the secondary token cannot be loaded, got %v", err)
+	}
+	if got := testutil.ToFloat64(tokenAuth.WithLabelValues(zone, "primary", "rejected")); got != rejected+1 {
+		t.Fatalf("expected primary rejection counted once, got %v", got-rejected)
+	}
+}
+
+func TestRefresh_StaleOnAPIError(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(false)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(500)
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+	tf := filepath.Join(t.TempDir(), "tok")
+	_ = os.WriteFile(tf, []byte("tok"), 0o600)
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "file", Value: tf}, Timeout: time.Second, AllowedCIDRs: []string{"10.0.0.0/24"}, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fail.Store(true)
+	_ = p.refresh(context.Background())
+	if len(p.cache.LookupA("srv.zt.example.com.")) == 0 {
+		t.Fatal("stale cache should remain")
+	}
+}
+
+func TestRegisterMetrics_DoesNotPanicOnDuplicate(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registerMetrics(registry)
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("registerMetrics panicked on duplicate registration: %v", r)
+		}
+	}()
+
+	registerMetrics(registry)
+}
+
+func whoamiPlugin(t *testing.T) *ZtnetPlugin {
+	t.Helper()
+	p := basePlugin(t)
+	p.cache.SetWithMembers(
+		map[string][]net.IP{"server01.zt.example.com.": {net.ParseIP("10.147.20.5")}, "abcdef0123.zt.example.com.": {net.ParseIP("10.147.20.5")}},
+		map[string][]net.IP{"abcdef0123.zt.example.com.": {net.ParseIP("fd00::1")}},
+		MemberIndex{ByIP: map[string]MemberIdentity{"10.147.20.5": {NodeID: "abcdef0123", Name: "server01"}}},
+		mustAllowed(t, "10.147.0.0/16"),
+	)
+	return p
+}
+
+func TestServeDNS_Whoami_Member(t *testing.T) {
+	p := whoamiPlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.5"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("whoami.zt.example.com.", dns.TypeTXT)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected whoami TXT, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+	txt := rw.msg.Answer[0].(*dns.TXT).Txt
+	if !slices.Equal(txt, []string{"ip=10.147.20.5", "node=abcdef0123", "name=server01"}) {
+		t.Fatalf("unexpected whoami TXT: %v", txt)
+	}
+}
+
+func TestServeDNS_Whoami_NonMember(t *testing.T) {
+	p := whoamiPlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("whoami.zt.example.com.", dns.TypeTXT)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected whoami TXT, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+	if txt := rw.msg.Answer[0].(*dns.TXT).Txt; !slices.Equal(txt, []string{"ip=127.0.0.1"}) {
+		t.Fatalf("unexpected whoami TXT: %v", txt)
+	}
+}
+
+func TestServeDNS_Self(t *testing.T) {
+	p := whoamiPlugin(t)
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.5"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("self.zt.example.com.", dns.TypeAAAA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected self AAAA, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+	if got := rw.msg.Answer[0].(*dns.AAAA).AAAA.String(); got != "fd00::1" {
+		t.Fatalf("expected querier AAAA fd00::1, got %s", got)
+	}
+
+	rw = &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	rcode, _ = p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 0 {
+		t.Fatalf("expected NODATA for non-member self, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	}
+}
+
+func TestRefresh_BuildsMemberIndexAndSkipsReservedNames(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"abcdef0123","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]},{"nodeId":"0123456789","name":"whoami","authorized":true,"ipAssignments":["10.0.0.3"]}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n" {
+			_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	id, ok := p.cache.LookupMember(net.ParseIP("10.0.0.2"))
+	if !ok || id.NodeID != "abcdef0123" || id.Name != "srv" {
+		t.Fatalf("unexpected member identity: %#v ok=%v", id, ok)
+	}
+	if len(p.cache.LookupA("whoami.zt.example.com.")) != 0 {
+		t.Fatal("expected reserved member name to be skipped")
+	}
+	if len(p.cache.LookupA("0123456789.zt.example.com.")) != 1 {
+		t.Fatal("expected nodeID record for member with reserved name")
+	}
+}
+
+func viewPlugin(t *testing.T, views ...ViewRule) *ZtnetPlugin {
+	t.Helper()
+	p := basePlugin(t)
+	p.cfg.Views = views
+	p.cache.SetWithMembers(
+		map[string][]net.IP{
+			"build01.zt.example.com.": {net.ParseIP("10.147.20.5")},
+			"db01.zt.example.com.":    {net.ParseIP("10.147.20.6")},
+			"laptop.zt.example.com.":  {net.ParseIP("10.147.30.7")},
+		},
+		nil,
+		MemberIndex{
+			ByIP: map[string]MemberIdentity{
+				"10.147.30.7": {NodeID: "cccccccccc", Name: "laptop", Tags: []string{"contractor"}},
+			},
+			ByName: map[string]MemberIdentity{
+				"build01.zt.example.com.": {NodeID: "aaaaaaaaaa", Name: "build01", Tags: []string{"contractor"}},
+				"db01.zt.example.com.":    {NodeID: "bbbbbbbbbb", Name: "db01"},
+				"laptop.zt.example.com.":  {NodeID: "cccccccccc", Name: "laptop", Tags: []string{"contractor"}},
+			},
+		},
+		mustAllowed(t, "10.147.0.0/16"),
+	)
+	return p
+}
+
+func mustView(t *testing.T, args ...string) ViewRule {
+	t.Helper()
+	v, err := parseViewRule(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestServeDNS_View_TagSource(t *testing.T) {
+	p := viewPlugin(t, mustView(t, "tag:contractor", "tag:contractor"))
+	contractor := &net.UDPAddr{IP: net.ParseIP("10.147.30.7"), Port: 1111}
+	staff := &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}
+
+	for _, tc := range []struct {
+		src   net.Addr
+		name  string
+		rcode int
+	}{
+		{contractor, "build01.zt.example.com.", dns.RcodeSuccess},
+		{contractor, "laptop.zt.example.com.", dns.RcodeSuccess},
+		{contractor, "db01.zt.example.com.", dns.RcodeNameError},
+		{staff, "db01.zt.example.com.", dns.RcodeSuccess},
+	} {
+		rw := &fakeRW{remoteAddr: tc.src}
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		rcode, _ := p.ServeDNS(context.Background(), rw, req)
+		if rcode != tc.rcode {
+			t.Fatalf("%v -> %s: expected rcode %d, got %d", tc.src, tc.name, tc.rcode, rcode)
+		}
+	}
+}
+
+func TestServeDNS_View_CIDRSourceByName(t *testing.T) {
+	p := viewPlugin(t, mustView(t, "10.147.20.0/24", "DB01"))
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	req := new(dns.Msg)
+	req.SetQuestion("build01.zt.example.com.", dns.TypeA)
+	if rcode, _ := p.ServeDNS(context.Background(), rw, req); rcode != dns.RcodeNameError || len(rw.msg.Ns) == 0 {
+		t.Fatalf("expected NXDOMAIN outside view, got rcode=%d", rcode)
+	}
+	req.SetQuestion("db01.zt.example.com.", dns.TypeA)
+	if rcode, _ := p.ServeDNS(context.Background(), rw, req); rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected answer inside view, got rcode=%d", rcode)
+	}
+}
+
+func TestParseViewRule_Invalid(t *testing.T) {
+	for _, args := range [][]string{{"10.0.0.0/8"}, {"not-cidr", "db01"}, {"tag:", "db01"}, {"10.0.0.0/8", "tag:"}} {
+		if _, err := parseViewRule(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestFetchMembers_Tags(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"nodeId":"a","authorized":true,"tags":["Contractor",[1,2]," "]}]`))
+	}))
+	defer ts.Close()
+	c := &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}
+	members, err := c.FetchMembers(context.Background(), "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || !slices.Equal(members[0].Tags, []string{"contractor"}) {
+		t.Fatalf("unexpected member tags: %#v", members)
+	}
+}
+
+func TestAllowedNets_MemberIPs(t *testing.T) {
+	a, err := NewMemberAllowedNets([]string{"192.168.1.0/24"}, []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.2", "::ffff:10.0.0.2", "fd00::2", "192.168.1.9", "127.0.0.1"} {
+		if !a.Contains(net.ParseIP(ip)) {
+			t.Fatalf("expected %s to be allowed", ip)
+		}
+	}
+	if a.Contains(net.ParseIP("10.0.0.3")) {
+		t.Fatal("expected non-member IP to be denied")
+	}
+}
+
+func TestRefresh_ACLModeMembers(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/api/v1/network/n/member" {
-			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]},{"nodeId":"b","name":"old","authorized":false,"ipAssignments":["10.0.0.3"]}]`))
 			return
 		}
 		if r.URL.Path == "/api/v1/network/n" {
-			if invalid.Load() {
-				_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"not-cidr","via":null}]}}`))
-				return
-			}
-			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.66.0.0/16","via":null}]}}`))
+			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
 			return
 		}
 		w.WriteHeader(404)
 	}))
 	defer ts.Close()
 
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true, ACLMode: ACLModeMembers}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
 	if err := p.refresh(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	invalid.Store(true)
-	if err := p.refresh(context.Background()); err == nil {
-		t.Fatal("expected build allowlist error")
-	}
-	if !p.cache.IsAllowed(net.ParseIP("10.66.1.20"), true) {
-		t.Fatal("expected stale allowlist to remain on build error")
+	if !p.cache.IsAllowed(net.ParseIP("10.0.0.2"), true) {
+		t.Fatal("expected authorized member to be allowed")
 	}
-	if len(p.cache.LookupA("srv.zt.example.com.")) == 0 {
-		t.Fatal("expected stale DNS records to remain on build error")
+	if p.cache.IsAllowed(net.ParseIP("10.0.0.3"), true) || p.cache.IsAllowed(net.ParseIP("10.0.0.50"), true) {
+		t.Fatal("expected deauthorized member and routed non-member to be denied")
 	}
 }
 
-func TestCache_SetIsAllowed_Atomic(t *testing.T) {
-	rc := NewRecordCache()
-	rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.0.1")}}, nil, mustAllowed(t, "10.0.0.0/24"))
+func TestServeDNS_DenyActions(t *testing.T) {
+	external := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1111}
 
-	for i := 0; i < 2000; i++ {
-		if i%2 == 0 {
-			rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.0.1")}}, nil, mustAllowed(t, "10.0.0.0/24"))
-		} else {
-			rc.Set(map[string][]net.IP{"srv.": {net.ParseIP("10.0.1.1")}}, nil, mustAllowed(t, "10.0.1.0/24"))
-		}
-		s := rc.load()
-		ips := s.a["srv."]
-		if len(ips) == 0 {
-			continue
+	p := basePlugin(t)
+	p.cfg.Deny = DenyConfig{Action: DenyActionNXDomain}
+	rw := &fakeRW{remoteAddr: external}
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	rcode, _ := p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeNameError || len(rw.msg.Answer) != 0 || len(rw.msg.Ns) != 1 {
+		t.Fatalf("expected NXDOMAIN with SOA, got rcode=%d", rcode)
+	}
+
+	p.cfg.Deny = DenyConfig{Action: DenyActionDrop}
+	rw = &fakeRW{remoteAddr: external}
+	rcode, _ = p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeSuccess || rw.msg != nil {
+		t.Fatalf("expected silent drop, got rcode=%d msg=%v", rcode, rw.msg != nil)
+	}
+
+	p.cfg.Deny = DenyConfig{Action: DenyActionEDE, EDECode: dns.ExtendedErrorCodeProhibited, EDEText: "not a member"}
+	rw = &fakeRW{remoteAddr: external}
+	req.SetEdns0(1232, false)
+	rcode, _ = p.ServeDNS(context.Background(), rw, req)
+	if rcode != dns.RcodeRefused || rw.msg.IsEdns0() == nil {
+		t.Fatalf("expected REFUSED with OPT, got rcode=%d", rcode)
+	}
+	ede, ok := rw.msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeProhibited || ede.ExtraText != "not a member" {
+		t.Fatalf("unexpected EDE option: %#v", rw.msg.IsEdns0().Option)
+	}
+}
+
+func TestParseDenyAction(t *testing.T) {
+	d, err := parseDenyAction([]string{"ede", "15", "blocked", "by", "ztnet"})
+	if err != nil || d.Action != DenyActionEDE || d.EDECode != dns.ExtendedErrorCodeBlocked || d.EDEText != "blocked by ztnet" {
+		t.Fatalf("unexpected deny config: %#v err=%v", d, err)
+	}
+	for _, args := range [][]string{{"ignore"}, {"drop", "x"}, {"ede", "70000"}} {
+		if _, err := parseDenyAction(args); err == nil {
+			t.Fatalf("expected error for %v", args)
 		}
-		if s.allowed == nil || !s.allowed.Contains(ips[0]) {
-			t.Fatal("observed non-atomic record/allowlist snapshot")
+	}
+}
+
+func TestRateLimiter_BucketAndSlip(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 2, IPv4Prefix: 24, IPv6Prefix: 128, Slip: 2})
+	l.now = func() time.Time { return now }
+
+	src := net.ParseIP("10.147.20.9")
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(src); !ok {
+			t.Fatalf("expected burst query %d to pass", i)
 		}
 	}
+	if ok, slip := l.allow(net.ParseIP("10.147.20.10")); ok || slip {
+		t.Fatalf("expected same /24 to share bucket and drop first limited query, got ok=%v slip=%v", ok, slip)
+	}
+	if ok, slip := l.allow(src); ok || !slip {
+		t.Fatalf("expected second limited query to slip, got ok=%v slip=%v", ok, slip)
+	}
+	if ok, _ := l.allow(net.ParseIP("127.0.0.1")); !ok {
+		t.Fatal("expected loopback to be exempt")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.allow(src); !ok {
+		t.Fatal("expected bucket refill after one second")
+	}
 }
 
-func TestServeDNS_REFUSED_NilSrcIP(t *testing.T) {
+func TestRateLimiter_EvictsLeastRecentlySeen(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, IPv4Prefix: 32, IPv6Prefix: 128})
+	l.now = func() time.Time { return now }
+
+	first := net.ParseIP("10.0.0.1")
+	if ok, _ := l.allow(first); !ok {
+		t.Fatal("expected first query to pass")
+	}
+	for i := 0; i < maxRateBuckets; i++ {
+		ip := net.IPv4(11, byte(i>>16), byte(i>>8), byte(i))
+		l.allow(ip)
+	}
+	if len(l.buckets) != maxRateBuckets || l.recent.Len() != maxRateBuckets {
+		t.Fatalf("expected %d buckets, got %d/%d", maxRateBuckets, len(l.buckets), l.recent.Len())
+	}
+	if _, ok := l.buckets[l.key(first)]; ok {
+		t.Fatal("expected the least recently seen bucket to be evicted")
+	}
+	n := maxRateBuckets - 1
+	last := net.IPv4(11, byte(n>>16), byte(n>>8), byte(n))
+	if ok, _ := l.allow(last); ok {
+		t.Fatal("expected the most recent bucket to be kept and empty")
+	}
+}
+
+func TestServeDNS_RateLimited(t *testing.T) {
 	p := basePlugin(t)
-	rw := &fakeRW{}
+	p.limiter = newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, IPv4Prefix: 32, IPv6Prefix: 128, Slip: 1})
 	req := new(dns.Msg)
 	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeRefused {
-		t.Fatalf("expected REFUSED for nil src ip, got %d", rcode)
+
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, req); rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected first query answered, got rcode=%d", rcode)
+	}
+	rw = &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, req); rcode != dns.RcodeSuccess || rw.msg == nil || !rw.msg.Truncated || len(rw.msg.Answer) != 0 {
+		t.Fatalf("expected truncated slip answer, got rcode=%d msg=%v", rcode, rw.msg)
 	}
 }
 
-func TestServeDNS_NilAllowlist_StrictOff(t *testing.T) {
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{TTL: 60, StrictStart: false}, cache: NewRecordCache(), Next: nextOK{}}
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+func ecsRequest(name string, qtype uint16, client string) *dns.Msg {
 	req := new(dns.Msg)
-	req.SetQuestion("missing.zt.example.com.", dns.TypeA)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeNameError || len(rw.msg.Ns) == 0 {
-		t.Fatalf("expected NXDOMAIN with SOA, got rcode=%d ns=%d", rcode, len(rw.msg.Ns))
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(1232, false)
+	ip := net.ParseIP(client)
+	family, mask := uint16(1), uint8(32)
+	if ip.To4() == nil {
+		family, mask = 2, 128
 	}
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: mask, Address: ip})
+	return req
 }
 
-func TestServeDNS_ANY(t *testing.T) {
+func TestServeDNS_TrustedForwarderECS(t *testing.T) {
 	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	nets, err := parseCIDRs([]string{"192.168.55.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.TrustedForwarders = nets
+	forwarder := &net.UDPAddr{IP: net.ParseIP("192.168.55.1"), Port: 1111}
+
+	rw := &fakeRW{remoteAddr: forwarder}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, ecsRequest("server01.zt.example.com.", dns.TypeA, "10.147.20.9")); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected ECS client inside allowlist to be answered, got rcode=%d", rcode)
+	}
+	rw = &fakeRW{remoteAddr: forwarder}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, ecsRequest("server01.zt.example.com.", dns.TypeA, "8.8.8.8")); rcode != dns.RcodeRefused {
+		t.Fatalf("expected ECS client outside allowlist to be refused, got rcode=%d", rcode)
+	}
+
+	untrusted := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("8.8.4.4"), Port: 1111}}
+	if rcode, _ := p.ServeDNS(context.Background(), untrusted, ecsRequest("server01.zt.example.com.", dns.TypeA, "10.147.20.9")); rcode != dns.RcodeRefused {
+		t.Fatalf("expected ECS from untrusted peer to be ignored, got rcode=%d", rcode)
+	}
+}
+
+func TestServeDNS_TrustedForwarderECSPrefix(t *testing.T) {
+	p := whoamiPlugin(t)
+	nets, err := parseCIDRs([]string{"192.168.55.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.TrustedForwarders = nets
+	forwarder := &net.UDPAddr{IP: net.ParseIP("192.168.55.1"), Port: 1111}
+	query := func(name string, qtype uint16, mask uint8) (int, *dns.Msg) {
+		req := ecsRequest(name, qtype, "10.147.20.5")
+		req.IsEdns0().Option[0].(*dns.EDNS0_SUBNET).SourceNetmask = mask
+		rw := &fakeRW{remoteAddr: forwarder}
+		rcode, _ := p.ServeDNS(context.Background(), rw, req)
+		return rcode, rw.msg
+	}
+	scope := func(m *dns.Msg) int {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+					return int(ecs.SourceScope)
+				}
+			}
+		}
+		return -1
+	}
+
+	rcode, m := query("whoami.zt.example.com.", dns.TypeTXT, 24)
+	if rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("expected whoami TXT for /24 client, got rcode=%d", rcode)
+	}
+	if txt := m.Answer[0].(*dns.TXT).Txt; !slices.Equal(txt, []string{"ip=10.147.20.0/24"}) {
+		t.Fatalf("expected /24 client not to be matched to a member, got %v", txt)
+	}
+	if got := scope(m); got != 24 {
+		t.Fatalf("expected ECS echoed with scope 24, got %d", got)
+	}
+	if rcode, m = query("self.zt.example.com.", dns.TypeAAAA, 24); rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("expected NODATA self for /24 client, got rcode=%d answers=%d", rcode, len(m.Answer))
+	}
+	if rcode, m = query("self.zt.example.com.", dns.TypeAAAA, 32); rcode != dns.RcodeSuccess || len(m.Answer) != 1 || scope(m) != 32 {
+		t.Fatalf("expected self AAAA with scope 32 for /32 client, got rcode=%d msg=%v", rcode, m)
+	}
+	if rcode, m = query("server01.zt.example.com.", dns.TypeA, 8); rcode != dns.RcodeRefused || scope(m) != 8 {
+		t.Fatalf("expected /8 client wider than the allowlist to be refused with ECS, got rcode=%d", rcode)
+	}
+
+	members, err := NewMemberAllowedNets(nil, []net.IP{net.ParseIP("10.147.20.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, _ := net.ParseCIDR("10.147.20.0/24")
+	if members.ContainsNet(n) {
+		t.Fatal("expected a member IP not to allow its /24")
+	}
+}
+
+type fakeDoHRW struct {
+	fakeRW
+	req *http.Request
+}
+
+func (f *fakeDoHRW) Request() *http.Request { return f.req }
+
+func TestClientSourceIP_TrustedProxy(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", nil)
+	req.Header.Add("X-Forwarded-For", "8.8.8.8, 10.147.20.9")
+	req.Header.Add("X-Forwarded-For", "172.16.0.3")
+	rw := &fakeDoHRW{fakeRW: fakeRW{remoteAddr: &net.TCPAddr{IP: net.ParseIP("172.16.0.2"), Port: 443}}, req: req}
+	if got := clientSourceIP(context.Background(), rw, trusted, ""); got.String() != "10.147.20.9" {
+		t.Fatalf("expected first untrusted X-Forwarded-For hop, got %v", got)
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, "proxy/client_ip", func() string { return "10.147.30.7" })
+	if got := clientSourceIP(ctx, rw, trusted, "proxy/client_ip"); got.String() != "10.147.30.7" {
+		t.Fatalf("expected metadata client address, got %v", got)
+	}
+
+	rw.remoteAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 443}
+	if got := clientSourceIP(ctx, rw, trusted, "proxy/client_ip"); got.String() != "203.0.113.5" {
+		t.Fatalf("expected untrusted peer address to be used as-is, got %v", got)
+	}
+}
+
+func TestServeDNS_TSIGBypassesAllowlist(t *testing.T) {
+	p := basePlugin(t)
+	p.cfg.TSIGKeys = map[string]string{"admin.": "c2VjcmV0"}
+	roaming := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 1111}
+
 	req := new(dns.Msg)
-	req.SetQuestion("server01.zt.example.com.", dns.TypeANY)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	req = signedRequest(req, "admin.", "c2VjcmV0")
+	rw := &fakeRW{remoteAddr: roaming}
 	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 2 {
-		t.Fatalf("expected both A and AAAA answers, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("expected TSIG query to be answered, got rcode=%d", rcode)
+	}
+	if ts := rw.msg.IsTsig(); ts == nil || ts.Hdr.Name != "admin." {
+		t.Fatal("expected response to carry TSIG for signing")
+	}
+
+	rw = &fakeRW{remoteAddr: roaming, tsigErr: dns.ErrSig}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, req); rcode != dns.RcodeNotAuth {
+		t.Fatalf("expected NOTAUTH for bad signature, got rcode=%d", rcode)
+	}
+
+	other := new(dns.Msg)
+	other.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	other.SetTsig("unknown.", dns.HmacSHA256, 300, time.Now().Unix())
+	rw = &fakeRW{remoteAddr: roaming}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, other); rcode != dns.RcodeRefused {
+		t.Fatalf("expected unknown key to fall back to allowlist, got rcode=%d", rcode)
+	}
+}
+
+func TestServeDNS_TSIGForgedMACOnUnverifiedTransport(t *testing.T) {
+	p := whoamiPlugin(t)
+	p.cfg.TSIGKeys = map[string]string{"admin.": "c2VjcmV0"}
+	p.cfg.DynamicUpdates = true
+	// like DoH, DoQ and gRPC writers, fakeRW reports every TSIG as valid.
+	doh := &fakeRW{remoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 443}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
+	req.SetTsig("admin.", dns.HmacSHA256, 300, time.Now().Unix())
+	req.IsTsig().MAC = "deadbeef"
+	req.IsTsig().MACSize = 4
+	if rcode, _ := p.ServeDNS(context.Background(), doh, req); rcode != dns.RcodeNotAuth || len(doh.msg.Answer) != 0 {
+		t.Fatalf("expected NOTAUTH for a forged MAC, got rcode=%d answers=%d", rcode, len(doh.msg.Answer))
+	}
+
+	rr, _ := dns.NewRR("laptop.zt.example.com. 60 IN A 10.147.20.5")
+	update := updateRequest("zt.example.com.", rr)
+	update.IsTsig().MAC = "deadbeef"
+	doh = &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.5"), Port: 1111}}
+	if rcode, _ := p.ServeDNS(context.Background(), doh, update); rcode != dns.RcodeNotAuth {
+		t.Fatalf("expected NOTAUTH for a forged update, got rcode=%d", rcode)
+	}
+}
+
+func updateRequest(zone string, rrs ...dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Insert(rrs)
+	return signedRequest(m, "admin.", "c2VjcmV0")
+}
+
+// signedRequest signs m with key and returns it as a server would receive it.
+func signedRequest(m *dns.Msg, key, secret string) *dns.Msg {
+	m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	buf, _, err := dns.TsigGenerate(m, secret, "", false)
+	if err != nil {
+		panic(err)
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(buf); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func TestServeDNS_DynamicUpdateRenamesMember(t *testing.T) {
+	var gotPath, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.Method+" "+r.URL.Path, string(b)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	p := whoamiPlugin(t)
+	p.cfg.TSIGKeys = map[string]string{"admin.": "c2VjcmV0"}
+	p.cfg.DynamicUpdates = true
+	p.cfg.Token = TokenConfig{Source: TokenSourceInline, Value: "tok"}
+	p.cfg.Timeout = time.Second
+	p.api = &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}
+	member := &net.UDPAddr{IP: net.ParseIP("10.147.20.5"), Port: 1111}
+
+	rr, _ := dns.NewRR("laptop.zt.example.com. 60 IN A 10.147.20.5")
+	rw := &fakeRW{remoteAddr: member}
+	rcode, _ := p.ServeDNS(context.Background(), rw, updateRequest("zt.example.com.", rr))
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("expected update success, got rcode=%d", rcode)
+	}
+	if gotPath != "POST /api/v1/network/n/member/abcdef0123" || gotBody != `{"name":"laptop"}` {
+		t.Fatalf("unexpected API call: %s %s", gotPath, gotBody)
+	}
+
+	rw = &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, updateRequest("zt.example.com.", rr)); rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for non-member source, got rcode=%d", rcode)
+	}
+
+	unsigned := new(dns.Msg)
+	unsigned.SetUpdate("zt.example.com.")
+	unsigned.Insert([]dns.RR{rr})
+	rw = &fakeRW{remoteAddr: member}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, unsigned); rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for unsigned update, got rcode=%d", rcode)
+	}
+
+	p.cache.SetWithMembers(nil, nil, MemberIndex{
+		ByIP:   map[string]MemberIdentity{"10.147.20.5": {NodeID: "abcdef0123"}},
+		ByName: map[string]MemberIdentity{"laptop.zt.example.com.": {NodeID: "0123456789", Name: "laptop"}},
+	}, mustAllowed(t, "10.147.0.0/16"))
+	rw = &fakeRW{remoteAddr: member}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, updateRequest("zt.example.com.", rr)); rcode != dns.RcodeYXDomain {
+		t.Fatalf("expected YXDOMAIN for name owned by another member, got rcode=%d", rcode)
+	}
+}
+
+func TestServeDNS_UnsignedUpdateChecksAllowlistAndRateLimit(t *testing.T) {
+	p := whoamiPlugin(t)
+	p.cfg.Deny.Action = DenyActionDrop
+	rr, _ := dns.NewRR("laptop.zt.example.com. 60 IN A 10.147.20.5")
+	unsigned := new(dns.Msg)
+	unsigned.SetUpdate("zt.example.com.")
+	unsigned.Insert([]dns.RR{rr})
+
+	refused := testutil.ToFloat64(updateCount.WithLabelValues(p.zone, "REFUSED"))
+	dropped := testutil.ToFloat64(deniedCount.WithLabelValues(p.zone, DenyActionDrop))
+	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 1111}}
+	_, _ = p.ServeDNS(context.Background(), rw, unsigned)
+	if rw.msg != nil {
+		t.Fatalf("expected update from outside the allowlist to be dropped, got %v", rw.msg)
+	}
+	if got := testutil.ToFloat64(deniedCount.WithLabelValues(p.zone, DenyActionDrop)); got != dropped+1 {
+		t.Fatalf("expected update to be counted as denied, got %v", got-dropped)
+	}
+
+	p.limiter = newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, IPv4Prefix: 32, IPv6Prefix: 128})
+	member := &net.UDPAddr{IP: net.ParseIP("10.147.20.5"), Port: 1111}
+	rw = &fakeRW{remoteAddr: member}
+	if rcode, _ := p.ServeDNS(context.Background(), rw, unsigned); rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for unsigned update from allowed source, got rcode=%d", rcode)
+	}
+	rw = &fakeRW{remoteAddr: member}
+	_, _ = p.ServeDNS(context.Background(), rw, unsigned)
+	if rw.msg != nil {
+		t.Fatal("expected rate limited update to be dropped")
+	}
+	if got := testutil.ToFloat64(updateCount.WithLabelValues(p.zone, "REFUSED")); got != refused+1 {
+		t.Fatalf("expected only the allowed update to reach the update handler, got %v", got-refused)
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookHandler(t *testing.T) {
+	sf := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(sf, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Webhook: WebhookConfig{SecretFile: sf}}, trigger: make(chan struct{}, 1)}
+	h := p.webhookHandler()
+	body := []byte(`{"event":"member_authorized"}`)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+	req.Header.Set(webhookSignatureHeader, signWebhook("wrong", body))
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || len(p.trigger) != 0 {
+		t.Fatalf("expected 401 without trigger, got %d pending=%d", rec.Code, len(p.trigger))
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+	req.Header.Set(webhookSignatureHeader, signWebhook("s3cret", body))
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted || len(p.trigger) != 1 {
+		t.Fatalf("expected 202 with trigger, got %d pending=%d", rec.Code, len(p.trigger))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+func TestStart_TriggeredRefreshIsDebounced(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			calls.Add(1)
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
+
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, Refresh: time.Hour, Webhook: WebhookConfig{Debounce: 50 * time.Millisecond}}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}, trigger: make(chan struct{}, 1)}
+	p.start(context.Background())
+	defer p.stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		p.requestRefresh()
+	}
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected initial plus one debounced refresh, got %d", got)
+	}
+}
+
+func TestStart_TokenFileRotationRefreshesImmediately(t *testing.T) {
+	var memberCalls sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("x-ztnet-auth")
+		if token == "revoked" || token == "bogus" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/v1/network/n/member" {
+			n, _ := memberCalls.LoadOrStore(token, new(atomic.Int32))
+			n.(*atomic.Int32).Add(1)
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
+	calls := func(token string) int32 {
+		n, ok := memberCalls.Load(token)
+		if !ok {
+			return 0
+		}
+		return n.(*atomic.Int32).Load()
 	}
-}
-
-func TestServeDNS_SOA(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
 
-	apexReq := new(dns.Msg)
-	apexReq.SetQuestion("zt.example.com.", dns.TypeSOA)
-	rcode, _ := p.ServeDNS(context.Background(), rw, apexReq)
-	if rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
-		t.Fatalf("expected apex SOA answer, got rcode=%d answers=%d", rcode, len(rw.msg.Answer))
+	tf := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tf, []byte("revoked"), 0o600); err != nil {
+		t.Fatal(err)
 	}
-	if _, ok := rw.msg.Answer[0].(*dns.SOA); !ok {
-		t.Fatalf("expected SOA answer, got %T", rw.msg.Answer[0])
+	p := &ZtnetPlugin{zone: "tokenwatch.test.", cfg: Config{Token: TokenConfig{Source: TokenSourceFile, Value: tf}, Timeout: time.Second, Refresh: time.Hour}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}, trigger: make(chan struct{}, 1)}
+	p.start(context.Background())
+	defer p.stop()
+	if testutil.ToFloat64(tokenMtime.WithLabelValues("tokenwatch.test.")) == 0 {
+		t.Fatal("expected token file change time exported")
 	}
 
-	nonexistentReq := new(dns.Msg)
-	nonexistentReq.SetQuestion("anything.zt.example.com.", dns.TypeSOA)
-	rcode, _ = p.ServeDNS(context.Background(), rw, nonexistentReq)
-	if rcode != dns.RcodeNameError || len(rw.msg.Ns) != 1 || len(rw.msg.Answer) != 0 {
-		t.Fatalf("expected NXDOMAIN with SOA in authority, got rcode=%d ns=%d answer=%d", rcode, len(rw.msg.Ns), len(rw.msg.Answer))
+	rejected := testutil.ToFloat64(tokenReload.WithLabelValues("tokenwatch.test.", TokenSourceFile, "rejected"))
+	if err := os.WriteFile(tf, []byte("bogus"), 0o600); err != nil {
+		t.Fatal(err)
 	}
-	if _, ok := rw.msg.Ns[0].(*dns.SOA); !ok {
-		t.Fatalf("expected SOA in authority, got %T", rw.msg.Ns[0])
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(tokenReload.WithLabelValues("tokenwatch.test.", TokenSourceFile, "rejected")) == rejected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if testutil.ToFloat64(tokenReload.WithLabelValues("tokenwatch.test.", TokenSourceFile, "rejected")) != rejected+1 {
+		t.Fatal("expected rejected token counted")
 	}
-}
 
-func TestServeDNS_OutOfZone(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("google.com.", dns.TypeA)
-	rcode, err := p.ServeDNS(context.Background(), rw, req)
-	if err != nil || rcode != dns.RcodeSuccess {
-		t.Fatalf("expected passthrough success, got rcode=%d err=%v", rcode, err)
+	// atomic replacement, as done by ztnetool.
+	tmp := tf + ".new"
+	if err := os.WriteFile(tmp, []byte("fresh"), 0o600); err != nil {
+		t.Fatal(err)
 	}
-	if rw.msg != nil {
-		t.Fatal("out-of-zone query should be handled by next plugin")
+	if err := os.Rename(tmp, tf); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestServeDNS_NoQuestion(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	rcode, err := p.ServeDNS(context.Background(), rw, new(dns.Msg))
-	if err != nil || rcode != dns.RcodeServerFailure {
-		t.Fatalf("expected SERVFAIL, got rcode=%d err=%v", rcode, err)
+	for calls("fresh") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if calls("fresh") == 0 {
+		t.Fatal("expected immediate refresh with the rotated token")
+	}
+	if !p.Ready() {
+		t.Fatal("expected successful refresh after rotation")
 	}
 }
 
-func TestServeDNS_DNSSD_TXT(t *testing.T) {
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{TTL: 60, SearchDomain: "corp.example.com."}, cache: NewRecordCache(), Next: nextOK{}}
-	p.cache.Set(nil, nil, mustAllowed(t, "10.147.0.0/16"))
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("_dns-sd._udp.zt.example.com.", dns.TypeTXT)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeSuccess {
-		t.Fatalf("expected TXT answer, got rcode=%d", rcode)
+func TestAdminHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			_, _ = w.Write([]byte(`[{"nodeId":"abcdef0123","name":"srv","authorized":true,"ipAssignments":["10.0.0.2","fd00::2"]}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+	}))
+	defer ts.Close()
+	tf := filepath.Join(t.TempDir(), "admin")
+	if err := os.WriteFile(tf, []byte("adm1n"), 0o600); err != nil {
+		t.Fatal(err)
 	}
-	assertDNSSDTXTPath(t, rw.msg, "corp.example.com.")
-}
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, AutoAllowZT: true, Admin: AdminConfig{TokenFile: tf}}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	h := p.adminHandler()
 
-func TestServeDNS_ShortName_Hit(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("server01.", dns.TypeA)
-	rcode, err := p.ServeDNS(context.Background(), rw, req)
-	if err != nil || rcode != dns.RcodeSuccess {
-		t.Fatalf("expected short-name hit, got rcode=%d err=%v", rcode, err)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshot", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without bearer token, got %d", rec.Code)
 	}
-	if rw.msg == nil || len(rw.msg.Answer) != 1 {
-		t.Fatalf("expected one short-name answer, got %d", len(rw.msg.Answer))
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.Header.Set("Authorization", "Bearer adm1n")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected forced refresh to succeed, got %d %s", rec.Code, rec.Body.String())
 	}
-}
 
-func TestServeDNS_ShortName_Miss(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("unknown.", dns.TypeA)
-	rcode, err := p.ServeDNS(context.Background(), rw, req)
-	if err != nil || rcode != dns.RcodeSuccess {
-		t.Fatalf("expected passthrough for missing short-name, got rcode=%d err=%v", rcode, err)
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/snapshot", nil)
+	req.Header.Set("Authorization", "Bearer adm1n")
+	h.ServeHTTP(rec, req)
+	var snap adminSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snap); err != nil {
+		t.Fatal(err)
 	}
-	if rw.msg != nil {
-		t.Fatal("missing short-name should pass to next plugin")
+	if snap.Serial != 2 || snap.LastRefresh == nil || snap.LastError != "" || !snap.Ready {
+		t.Fatalf("unexpected snapshot status: %#v", snap)
+	}
+	if rec := snap.Records["srv.zt.example.com."]; !slices.Equal(rec.A, []string{"10.0.0.2"}) || !slices.Equal(rec.AAAA, []string{"fd00::2"}) {
+		t.Fatalf("unexpected snapshot records: %#v", snap.Records)
+	}
+	if !slices.Contains(snap.Allowed, "10.0.0.0/24") {
+		t.Fatalf("expected route CIDR in allowlist, got %v", snap.Allowed)
 	}
 }
 
-func TestServeDNS_ShortName_Off(t *testing.T) {
-	p := basePlugin(t)
-	p.cfg.AllowShort = false
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("server01.", dns.TypeA)
-	rcode, err := p.ServeDNS(context.Background(), rw, req)
-	if err != nil || rcode != dns.RcodeSuccess {
-		t.Fatalf("expected out-of-zone passthrough when short names disabled, got rcode=%d err=%v", rcode, err)
+func TestValidateLoopbackAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8054", "[::1]:8054", "localhost:8054"} {
+		if err := validateLoopbackAddr(addr); err != nil {
+			t.Fatalf("expected %s to be accepted: %v", addr, err)
+		}
 	}
-	if rw.msg != nil {
-		t.Fatal("short name should stay out-of-zone and pass to next plugin")
+	for _, addr := range []string{"0.0.0.0:8054", ":8054", "10.0.0.1:8054", "127.0.0.1"} {
+		if err := validateLoopbackAddr(addr); err == nil {
+			t.Fatalf("expected %s to be rejected", addr)
+		}
 	}
 }
 
-func TestServeDNS_AllowShort_DoesNotChangeInZoneMiss(t *testing.T) {
-	p := basePlugin(t)
-	p.cfg.AllowShort = true
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("unknown.zt.example.com.", dns.TypeA)
-	rcode, err := p.ServeDNS(context.Background(), rw, req)
-	if err != nil || rcode != dns.RcodeNameError {
-		t.Fatalf("expected NXDOMAIN for in-zone miss, got rcode=%d err=%v", rcode, err)
+func TestReadyAndDegraded(t *testing.T) {
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{StaleThreshold: time.Minute}, cache: NewRecordCache()}
+	if p.Ready() || !p.Degraded() {
+		t.Fatal("expected not ready and degraded before the first refresh")
 	}
-	if rw.msg == nil || len(rw.msg.Ns) == 0 {
-		t.Fatal("expected SOA in authority for in-zone miss")
+	p.status.record(nil)
+	p.checkHealth()
+	if !p.Ready() || p.Degraded() {
+		t.Fatal("expected ready and healthy after a successful refresh")
+	}
+	p.status.record(errors.New("api down"))
+	p.status.mu.Lock()
+	p.status.state.lastOK = time.Now().Add(-2 * time.Minute)
+	p.status.mu.Unlock()
+	if !p.Ready() || !p.Degraded() {
+		t.Fatal("expected ready but degraded once the snapshot is stale")
+	}
+	p.cfg.StaleThreshold = 0
+	if p.Degraded() {
+		t.Fatal("expected stale detection disabled with zero threshold")
 	}
 }
 
-func TestServeDNS_DNSSD_Custom(t *testing.T) {
-	p := basePlugin(t)
-	p.cfg.SearchDomain = "corp.example."
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.20.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("_dns-sd._udp.zt.example.com.", dns.TypeTXT)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeSuccess {
-		t.Fatalf("expected TXT answer for custom search domain, got rcode=%d", rcode)
+func TestWaitForSync(t *testing.T) {
+	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{WaitForSync: 100 * time.Millisecond}, cache: NewRecordCache()}
+	p.status.record(errors.New("api down"))
+	if err := p.waitForSync(); err == nil || !strings.Contains(err.Error(), "api down") {
+		t.Fatalf("expected sync timeout error with last refresh error, got %v", err)
+	}
+	p.cfg.WaitForSyncWarn = true
+	if err := p.waitForSync(); err != nil {
+		t.Fatalf("expected warn mode to continue, got %v", err)
 	}
-	assertDNSSDTXTPath(t, rw.msg, "corp.example.")
-}
 
-func TestServeDNS_Allowed_ZT(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.147.99.9"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeSuccess {
-		t.Fatalf("expected allowed ZT query, got rcode=%d", rcode)
+	p.cfg.WaitForSyncWarn = false
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.status.record(nil)
+	}()
+	p.cfg.WaitForSync = 5 * time.Second
+	if err := p.waitForSync(); err != nil {
+		t.Fatalf("expected sync to complete after first successful refresh, got %v", err)
 	}
 }
 
-func TestServeDNS_Allowed_Loopback(t *testing.T) {
-	p := basePlugin(t)
-	rw := &fakeRW{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1111}}
-	req := new(dns.Msg)
-	req.SetQuestion("server01.zt.example.com.", dns.TypeA)
-	rcode, _ := p.ServeDNS(context.Background(), rw, req)
-	if rcode != dns.RcodeSuccess {
-		t.Fatalf("expected loopback to be allowed, got rcode=%d", rcode)
+func TestLifecycle_RepeatedReloads(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			calls.Add(1)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
+
+	newInstance := func() *ZtnetPlugin {
+		return &ZtnetPlugin{zone: "reload.example.com.", cfg: Config{APIURL: ts.URL, NetworkID: "n", Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, Refresh: 10 * time.Millisecond, WaitForSync: 2 * time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
 	}
-}
 
-func TestIsBareName(t *testing.T) {
-	if !isBareName("host.") {
-		t.Fatal("expected host. to be bare")
+	first := newInstance()
+	if err := first.startup(); err != nil {
+		t.Fatal(err)
 	}
-	if isBareName("host.zt.example.com.") {
-		t.Fatal("expected fqdn with zone not to be bare")
+	prev := first
+	for i := 0; i < 5; i++ {
+		next := newInstance()
+		// a reload starts the new instance before shutting down the old one.
+		if err := next.startup(); err != nil {
+			t.Fatal(err)
+		}
+		if len(next.cache.LookupA("srv.reload.example.com.")) != 1 || !next.Ready() {
+			t.Fatalf("reload %d: expected snapshot carried over from previous instance", i)
+		}
+		if err := prev.shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		if next.poller() != first || first.cancel == nil {
+			t.Fatalf("reload %d: expected the original refresh loop to keep running", i)
+		}
+		prev = next
+	}
+	if err := prev.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if first.cancel != nil {
+		t.Fatal("expected final shutdown to stop the refresh loop")
+	}
+	pollersMu.Lock()
+	_, leaked := pollers[prev.pollerKey()]
+	pollersMu.Unlock()
+	if leaked {
+		t.Fatal("expected final shutdown to forget the shared poller")
+	}
+	// let requests canceled by shutdown drain on the server side first.
+	time.Sleep(20 * time.Millisecond)
+	before := calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != before {
+		t.Fatalf("expected no polling after final shutdown, got %d more refreshes", got-before)
 	}
 }
 
-func TestRefresh_StaleOnAPIError(t *testing.T) {
+func TestLifecycle_ReloadWithChangedSettingsAdoptsSnapshot(t *testing.T) {
 	var fail atomic.Bool
-	fail.Store(false)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if fail.Load() {
-			w.WriteHeader(500)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if r.URL.Path == "/api/v1/network/n/member" {
 			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
 			return
 		}
-		if r.URL.Path == "/api/v1/network/n" {
-			_, _ = w.Write([]byte(`{"config":{"routes":[{"target":"10.0.0.0/24","via":null}]}}`))
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
+
+	newInstance := func(refresh time.Duration) *ZtnetPlugin {
+		return &ZtnetPlugin{zone: "adopt.example.com.", cfg: Config{APIURL: ts.URL, NetworkID: "n", Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, Refresh: refresh, WaitForSync: 200 * time.Millisecond}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	}
+	old := newInstance(time.Hour)
+	if err := old.startup(); err != nil {
+		t.Fatal(err)
+	}
+	fail.Store(true)
+	next := newInstance(2 * time.Hour)
+	if err := next.startup(); err != nil {
+		t.Fatalf("expected reload with changed refresh to adopt the previous snapshot, got %v", err)
+	}
+	if next.poller() != next || len(next.cache.LookupA("srv.adopt.example.com.")) != 1 {
+		t.Fatal("expected a new loop serving the previous snapshot")
+	}
+	_ = old.shutdown()
+	_ = next.shutdown()
+}
+
+func TestLifecycle_FailedReloadReleasesPollers(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			calls.Add(1)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
 			return
 		}
-		w.WriteHeader(404)
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
 	}))
 	defer ts.Close()
-	tf := filepath.Join(t.TempDir(), "tok")
-	_ = os.WriteFile(tf, []byte("tok"), 0o600)
-	p := &ZtnetPlugin{zone: "zt.example.com.", cfg: Config{Token: TokenConfig{Source: "file", Value: tf}, Timeout: time.Second, AllowedCIDRs: []string{"10.0.0.0/24"}, AutoAllowZT: true}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client(), MaxRetries: 0}}
-	if err := p.refresh(context.Background()); err != nil {
+
+	newInstance := func(refresh time.Duration) *ZtnetPlugin {
+		return &ZtnetPlugin{zone: "failed.example.com.", cfg: Config{APIURL: ts.URL, NetworkID: "n", Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, Refresh: refresh, WaitForSync: 2 * time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}}
+	}
+	old := newInstance(time.Hour)
+	if err := old.startup(); err != nil {
 		t.Fatal(err)
 	}
-	fail.Store(true)
-	_ = p.refresh(context.Background())
-	if len(p.cache.LookupA("srv.zt.example.com.")) == 0 {
-		t.Fatal("stale cache should remain")
+	_ = commitPending(caddy.InstanceStartupEvent, nil)
+
+	// the reload starts both blocks, then fails before the old instance shuts down.
+	same, changed := newInstance(time.Hour), newInstance(10*time.Millisecond)
+	for _, p := range []*ZtnetPlugin{same, changed} {
+		if err := p.startup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := releasePending(); err != nil {
+		t.Fatal(err)
+	}
+	if changed.cancel != nil {
+		t.Fatal("expected the loop of the failed reload to stop")
+	}
+	pollersMu.Lock()
+	sp, leaked := pollers[old.pollerKey()], pollers[changed.pollerKey()] != nil
+	pollersMu.Unlock()
+	if leaked || sp == nil || sp.refs != 1 {
+		t.Fatalf("expected only the old instance to hold a poller, leaked=%v", leaked)
+	}
+	time.Sleep(20 * time.Millisecond)
+	before := calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != before {
+		t.Fatalf("expected no polling from the failed reload, got %d more refreshes", got-before)
+	}
+
+	if err := old.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if old.cancel != nil {
+		t.Fatal("expected the old instance to stop its loop on final shutdown")
 	}
 }
 
-func TestRegisterMetrics_DoesNotPanicOnDuplicate(t *testing.T) {
-	registry := prometheus.NewRegistry()
-	registerMetrics(registry)
+func TestClaimHTTPAddr_RejectsDuplicate(t *testing.T) {
+	c := caddy.NewTestController("dns", "")
+	if err := claimHTTPAddr(c, "webhook", "127.0.0.1:8053"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claimHTTPAddr(c, "admin", "127.0.0.1:8054"); err != nil {
+		t.Fatal(err)
+	}
+	err := claimHTTPAddr(c, "webhook", "127.0.0.1:8053")
+	if err == nil || !strings.Contains(err.Error(), "already used by another ztnet webhook listener") {
+		t.Fatalf("expected duplicate listener address to be rejected, got %v", err)
+	}
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			t.Fatalf("registerMetrics panicked on duplicate registration: %v", r)
+func TestLifecycle_SharedPollerRefCount(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/network/n/member" {
+			calls.Add(1)
+			_, _ = w.Write([]byte(`[{"nodeId":"a","name":"srv","authorized":true,"ipAssignments":["10.0.0.2"]}]`))
+			return
 		}
-	}()
+		_, _ = w.Write([]byte(`{"config":{"routes":[]}}`))
+	}))
+	defer ts.Close()
 
-	registerMetrics(registry)
+	newInstance := func(network string) *ZtnetPlugin {
+		return &ZtnetPlugin{zone: "shared.example.com.", cfg: Config{APIURL: ts.URL, NetworkID: network, Token: TokenConfig{Source: "inline", Value: "tok"}, Timeout: time.Second, Refresh: time.Hour, WaitForSync: 2 * time.Second}, cache: NewRecordCache(), api: &APIClient{BaseURL: ts.URL, NetworkID: "n", HTTPClient: ts.Client()}, trigger: make(chan struct{}, 1)}
+	}
+	v4, v6, other := newInstance("n"), newInstance("n"), newInstance("m")
+	for _, p := range []*ZtnetPlugin{v4, v6, other} {
+		if err := p.startup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v6.cache != v4.cache || v6.poller() != v4 || v6.cancel != nil {
+		t.Fatal("expected second server block to share cache and loop")
+	}
+	if other.cache == v4.cache || other.poller() != other {
+		t.Fatal("expected a different network to get its own poller")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected one initial refresh per poller, got %d", got)
+	}
+
+	v6.requestRefresh()
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected refresh request to reach the shared loop, got %d refreshes", got)
+	}
+	if err := v4.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if v4.cancel == nil {
+		t.Fatal("expected shared loop to survive while another instance uses it")
+	}
+	_ = v4.shutdown()
+	if v4.cancel == nil {
+		t.Fatal("expected repeated shutdown of one instance not to drop other references")
+	}
+	if err := v6.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if v4.cancel != nil {
+		t.Fatal("expected last reference to stop the shared loop")
+	}
+	_ = other.shutdown()
 }